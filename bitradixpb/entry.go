@@ -0,0 +1,50 @@
+// Package bitradixpb holds the protocol buffer messages for bitradix trees,
+// see entry.proto. The types are plain structs with the fields of the messages,
+// written by hand to avoid depending on the protobuf runtime. They are not
+// generated and do not implement proto.Message; to send them over gRPC,
+// generate the code for entry.proto with protoc-gen-go and copy the fields.
+package bitradixpb
+
+// ProtoEntry is a single key in a tree.
+type ProtoEntry struct {
+	Key   uint32 // the key, with the bits beyond Bits cleared
+	Bits  uint32 // the number of significant bits of the key
+	Value uint32 // the value stored under the key
+}
+
+// GetKey returns the key of e, or 0 when e is nil.
+func (e *ProtoEntry) GetKey() uint32 {
+	if e == nil {
+		return 0
+	}
+	return e.Key
+}
+
+// GetBits returns the number of bits of e, or 0 when e is nil.
+func (e *ProtoEntry) GetBits() uint32 {
+	if e == nil {
+		return 0
+	}
+	return e.Bits
+}
+
+// GetValue returns the value of e, or 0 when e is nil.
+func (e *ProtoEntry) GetValue() uint32 {
+	if e == nil {
+		return 0
+	}
+	return e.Value
+}
+
+// ProtoTable holds all the keys of a tree.
+type ProtoTable struct {
+	Entries []*ProtoEntry
+}
+
+// GetEntries returns the entries of t, or nil when t is nil.
+func (t *ProtoTable) GetEntries() []*ProtoEntry {
+	if t == nil {
+		return nil
+	}
+	return t.Entries
+}
@@ -0,0 +1,75 @@
+package bitradix
+
+// prefix32 is a key together with its number of significant bits.
+type prefix32 struct {
+	key  uint32
+	bits uint8
+}
+
+// Indexed32 is a Radix32 tree that keeps an index from values to the keys
+// storing them, so PrefixesForValue does not need to walk the tree.
+// The index holds keys instead of nodes, because nodes move around in the tree
+// on insert and remove. The tree must only be changed through Insert and
+// Remove of Indexed32, the tree returned by Tree is for reading.
+type Indexed32 struct {
+	tree  *Radix32
+	index map[uint32]map[prefix32]bool
+}
+
+// NewValueIndexed32 returns an empty, initialized Radix32 tree with a
+// value index.
+func NewValueIndexed32() *Indexed32 {
+	return &Indexed32{New32(), make(map[uint32]map[prefix32]bool)}
+}
+
+// Tree returns the tree of r.
+func (r *Indexed32) Tree() *Radix32 {
+	return r.tree
+}
+
+// Insert inserts a new value like Radix32.Insert and updates the index.
+func (r *Indexed32) Insert(n uint32, bits int, v uint32) *Radix32 {
+	n &= bitMask32(bits)
+	old := r.tree.exact(n, bits)
+	ov := uint32(0)
+	if old != nil {
+		ov = old.Value
+	}
+	// Insert first, so the index is left alone when it panics
+	x := r.tree.Insert(n, bits, v)
+	if old != nil {
+		r.drop(ov, prefix32{n, uint8(bits)})
+	}
+	if r.index[v] == nil {
+		r.index[v] = make(map[prefix32]bool)
+	}
+	r.index[v][prefix32{n, uint8(bits)}] = true
+	return x
+}
+
+// Remove removes a value like Radix32.Remove and updates the index.
+func (r *Indexed32) Remove(n uint32, bits int) *Radix32 {
+	x := r.tree.Remove(n, bits)
+	if x != nil {
+		r.drop(x.Value, prefix32{x.key, x.bits})
+	}
+	return x
+}
+
+// PrefixesForValue returns the nodes with value v in key order.
+func (r *Indexed32) PrefixesForValue(v uint32) []*Radix32 {
+	s := make([]*Radix32, 0, len(r.index[v]))
+	for p := range r.index[v] {
+		s = append(s, r.tree.exact(p.key, int(p.bits)))
+	}
+	sortNodes32(s)
+	return s
+}
+
+// Remove p from the index for value v.
+func (r *Indexed32) drop(v uint32, p prefix32) {
+	delete(r.index[v], p)
+	if len(r.index[v]) == 0 {
+		delete(r.index, v)
+	}
+}
@@ -0,0 +1,151 @@
+package bitradix
+
+// Minimize uses the ORTC algorithm from:
+//    Richard P. Draves, Christopher King, Srinivasan Venkatachary, Brian D. Zill.
+//    "Constructing optimal IP routing tables". INFOCOM 1999.
+// Because the tree can not store a "no route" value, addresses without a route
+// may not be covered by an aggregate. So ORTC is done for each maximal subtree
+// in which every address has a route.
+
+// onode32 is a node in the binary trie used by Minimize.
+type onode32 struct {
+	branch [2]*onode32
+	value  uint32   // the value stored, if set is true
+	set    bool     // a key ends here
+	full   bool     // all addresses below this node have a route
+	values []uint32 // the candidate values, sorted
+}
+
+// Minimize returns a new tree with the fewest keys possible, that gives the
+// same result as r for a longest prefix match on every address.
+// The tree r is only read, so lookups in r can continue while Minimize runs;
+// the new tree can then be swapped in, for instance by keeping the live tree
+// in an atomic.Value. The new tree has the mode and width of r.
+// r must be the root of the tree.
+func (r *Radix32) Minimize() *Radix32 {
+	o := new(onode32)
+	r.walk(func(r1 *Radix32) bool {
+		x := o
+		for bit := bitSize32 - 1; bit >= bitSize32-int(r1.bits); bit-- {
+			k := bitK32(r1.key, bit)
+			if x.branch[k] == nil {
+				x.branch[k] = new(onode32)
+			}
+			x = x.branch[k]
+		}
+		x.value = r1.Value
+		x.set = true
+		return true
+	})
+	o.normalize(0, false)
+	t := New32()
+	o.output(t, 0, 0, 0, false)
+	t.setMode(r)
+	return t
+}
+
+// Canonicalize returns the canonical form of the tree r: the tree Minimize
+// returns, built in key order. Trees that give the same result for a longest
+// prefix match on every address have StructEqual canonical forms, whichever
+// keys they store and however they were built, so the canonical form can be
+// used as a cache key. r must be the root of the tree.
+func (r *Radix32) Canonicalize() *Radix32 {
+	return r.Minimize()
+}
+
+// Push the values down to the leaf nodes, so that each node has zero or two
+// children, and compute the candidate values from the leafs upwards.
+// v is the value inherited from above, if ok is true.
+func (o *onode32) normalize(v uint32, ok bool) {
+	if o.set {
+		v, ok = o.value, true
+	}
+	if o.branch[0] == nil && o.branch[1] == nil {
+		o.full = ok
+		if ok {
+			o.values = []uint32{v}
+		}
+		return
+	}
+	for i := range o.branch {
+		if o.branch[i] == nil {
+			o.branch[i] = new(onode32)
+		}
+		o.branch[i].normalize(v, ok)
+	}
+	o.full = o.branch[0].full && o.branch[1].full
+	if !o.full {
+		return
+	}
+	o.values = intersect32(o.branch[0].values, o.branch[1].values)
+	if len(o.values) == 0 {
+		o.values = union32(o.branch[0].values, o.branch[1].values)
+	}
+}
+
+// Insert the keys needed in t. The node o is at depth with key n, v is the
+// value inherited from the nearest key inserted above, if ok is true.
+func (o *onode32) output(t *Radix32, n uint32, depth int, v uint32, ok bool) {
+	if o.full && (!ok || !contains32(o.values, v)) {
+		v, ok = o.values[0], true
+		t.Insert(n, depth, v)
+	}
+	for i, b := range o.branch {
+		if b != nil {
+			b.output(t, n|uint32(i)<<uint(bitSize32-1-depth), depth+1, v, ok)
+		}
+	}
+}
+
+// Return the values in both a and b, a and b must be sorted.
+func intersect32(a, b []uint32) []uint32 {
+	s := make([]uint32, 0)
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			s = append(s, a[i])
+			i++
+			j++
+		}
+	}
+	return s
+}
+
+// Return the values in a or b, a and b must be sorted.
+func union32(a, b []uint32) []uint32 {
+	s := make([]uint32, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] < b[j]:
+			s = append(s, a[i])
+			i++
+		case a[i] > b[j]:
+			s = append(s, b[j])
+			j++
+		default:
+			s = append(s, a[i])
+			i++
+			j++
+		}
+	}
+	s = append(s, a[i:]...)
+	return append(s, b[j:]...)
+}
+
+// Return true when v is in the sorted slice a.
+func contains32(a []uint32, v uint32) bool {
+	for _, x := range a {
+		if x == v {
+			return true
+		}
+		if x > v {
+			return false
+		}
+	}
+	return false
+}
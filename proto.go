@@ -0,0 +1,42 @@
+package bitradix
+
+import (
+	"fmt"
+
+	"github.com/abh/bitradix/bitradixpb"
+)
+
+// ToProtoEntries returns the keys in the tree r in order, as entries that map
+// onto the repeated field of a ProtoTable message.
+func (r *Radix32) ToProtoEntries() []*bitradixpb.ProtoEntry {
+	e := make([]*bitradixpb.ProtoEntry, 0)
+	r.walk(func(r1 *Radix32) bool {
+		e = append(e, &bitradixpb.ProtoEntry{Key: r1.key, Bits: uint32(r1.bits), Value: r1.Value})
+		return true
+	})
+	return e
+}
+
+// FromProtoEntries inserts the entries e in the tree r, nil entries are skipped.
+// As the entries usually come from the wire, they are checked first: when an
+// entry would not be accepted by TryInsert an error is returned and the tree
+// is not changed. r must be the root of the tree.
+func (r *Radix32) FromProtoEntries(e []*bitradixpb.ProtoEntry) error {
+	for i, e1 := range e {
+		if e1 == nil {
+			continue
+		}
+		if e1.GetBits() > uint32(bitSize32) {
+			return fmt.Errorf("bitradix: entry %d: %w", i, ErrPrefixLen)
+		}
+		if _, err := r.check(e1.GetKey(), int(e1.GetBits())); err != nil {
+			return fmt.Errorf("bitradix: entry %d: %w", i, err)
+		}
+	}
+	for _, e1 := range e {
+		if e1 != nil {
+			r.Insert(e1.GetKey(), int(e1.GetBits()), e1.GetValue())
+		}
+	}
+	return nil
+}
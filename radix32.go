@@ -8,6 +8,18 @@
 //    October 1968
 package bitradix
 
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"iter"
+	"math"
+	"math/bits"
+	"sort"
+	"sync/atomic"
+)
+
 // With help from:
 // http://faculty.simpson.edu/lydia.sinapova/www/cmsc250/LN250_Weiss/L08-Radix.htm
 
@@ -18,19 +30,152 @@ const (
 	mask64    = 0xFFFFFFFFFFFFFFFF
 )
 
+const (
+	flagCanonical = 1 << iota // reject keys with host bits set
+	flagDefault               // the root node stores the default route, a key with zero bits
+	flagAggregate             // merge sibling keys with equal values on insert
+)
+
+// The insertion sequence counter, shared by all trees. It is 64 bits wide, so
+// it never wraps around in practice, see Since.
+var seq32 uint64
+
+// Return the next insertion sequence number.
+func nextSeq32() uint64 {
+	return atomic.AddUint64(&seq32, 1)
+}
+
+// ErrHostBits is returned when a key with bits set beyond its prefix length
+// is inserted in a tree in canonical mode.
+var ErrHostBits = errors.New("bitradix: host bits set in key")
+
+// ErrNotFound is returned when a key that must be in the tree is not found.
+var ErrNotFound = errors.New("bitradix: key not found")
+
+// ErrPrefixLen is returned when a key is inserted with a negative number of
+// bits or more bits than the width of the tree, see NewWithBits32.
+var ErrPrefixLen = errors.New("bitradix: prefix length out of range")
+
+// ErrNoDefault is returned when a routing table has no default route.
+var ErrNoDefault = errors.New("bitradix: no default route")
+
 // Radix32 implements a radix tree with an uint32 as its key.
+// The fields are ordered to avoid padding, a node takes 48 bytes
+// on 64 bit platforms.
 type Radix32 struct {
 	branch [2]*Radix32 // branch[0] is left branch for 0, and branch[1] the right for 1
 	parent *Radix32
+	seq    uint64 // the insertion sequence number of the key, see Mark
 	key    uint32 // the key under which this value is stored
-	bits   int    // the number of significant bits, if 0 the key has not been set.
 	Value  uint32 // The value stored.
+	bits   uint8  // the number of significant bits, if 0 the key has not been set.
+	flags  uint8  // tree wide options and the default route, only used on the root node
+	width  uint8  // the largest number of bits a key may have, 0 for 32, only used on the root node
 	// A leaf node is a node where both branches are nil 
 }
 
+// OverlapPair32 holds two nodes of a Radix32 tree where the key of Less
+// contains the key of More.
+type OverlapPair32 struct {
+	Less *Radix32 // the less-specific prefix
+	More *Radix32 // the more-specific prefix
+}
+
+// InsertImpact describes what an insert in a Radix32 tree would change,
+// see PreviewInsert.
+type InsertImpact struct {
+	New       bool   // the key is not in the tree yet
+	Overwrite bool   // the key is in the tree with a different value
+	Old       uint32 // the value currently stored, if the key is in the tree
+	Shadowed  int    // the number of more-specific keys under the key
+}
+
+// OpKind is the kind of operation in an Op32.
+type OpKind int
+
+const (
+	OpInsert OpKind = iota // insert or overwrite the key
+	OpRemove               // remove the key, which must be present
+	OpUpdate               // change the value of the key, which must be present
+)
+
+// Op32 is an operation on a Radix32 tree, see Apply.
+type Op32 struct {
+	Kind  OpKind
+	Key   uint32
+	Bits  int
+	Value uint32 // not used for OpRemove
+}
+
+// Marker marks a point in the insertions in a tree, see Mark and Since.
+type Marker struct {
+	seq uint64
+}
+
+// Entry32 is a key with its number of significant bits and its value.
+type Entry32 struct {
+	Key   uint32
+	Bits  int
+	Value uint32
+}
+
+// MatchStatus tells how a key was matched in a lookup, see LookupStatus.
+type MatchStatus int
+
+const (
+	NoMatch      MatchStatus = iota // nothing matched
+	Exact                           // matched a key with all bits significant
+	LongerPrefix                    // matched a key that is not the default route
+	DefaultRoute                    // only the default route matched
+)
+
 // New32 returns an empty, initialized Radix32 tree.
 func New32() *Radix32 {
-	return &Radix32{[2]*Radix32{nil, nil}, nil, 0, 0, 0}
+	return &Radix32{[2]*Radix32{nil, nil}, nil, 0, 0, 0, 0, 0, 0}
+}
+
+// NewCanonical32 returns an empty, initialized Radix32 tree in canonical mode.
+// In this mode inserting a key that has bits set beyond its first bits bits
+// is an error, instead of masking those bits off.
+func NewCanonical32() *Radix32 {
+	r := New32()
+	r.flags |= flagCanonical
+	return r
+}
+
+// NewAutoAggregate32 returns an empty, initialized Radix32 tree that aggregates
+// on insert: when a key and its sibling (the key that only differs in the last
+// significant bit) are both stored with the same value, they are replaced by their
+// parent key, the key with one bit less. When a more-specific key is inserted
+// under a stored key, the stored key is split into the siblings along the path
+// to the new key first, so the tree de-aggregates again.
+func NewAutoAggregate32() *Radix32 {
+	r := New32()
+	r.flags |= flagAggregate
+	return r
+}
+
+// NewWithBits32 returns an empty, initialized Radix32 tree for keys of at most
+// width bits, stored in the most significant bits of the uint32. Inserting a
+// key with more bits is a bug, see Insert. width must be between 1 and 32.
+func NewWithBits32(width int) *Radix32 {
+	if width < 1 || width > bitSize32 {
+		panic("bitradix: width out of range")
+	}
+	r := New32()
+	if width < bitSize32 {
+		r.width = uint8(width)
+	}
+	return r
+}
+
+// Width returns the largest number of bits a key in the tree r may have.
+// r must be the root of the tree.
+func (r *Radix32) Width() int {
+	if r.width == 0 {
+		return bitSize32
+	}
+	return int(r.width)
 }
 
 // Key returns the key under which this node is stored.
@@ -39,9 +184,25 @@ func (r *Radix32) Key() uint32 {
 }
 
 // Bits returns the number of significant bits for the key.
-// A value of zero indicates a key that has not been set.
+// A value of zero indicates a key that has not been set, except for
+// the root node when it stores the default route.
 func (r *Radix32) Bits() int {
-	return r.bits
+	return int(r.bits)
+}
+
+// LookupStatus returns the value of the longest prefix match for n, together
+// with the kind of match found. r must be the root of the tree.
+func (r *Radix32) LookupStatus(n uint32) (uint32, MatchStatus) {
+	x := r.Find(n, bitSize32)
+	switch {
+	case x == nil:
+		return 0, NoMatch
+	case x.bits == bitSize32:
+		return x.Value, Exact
+	case x.bits == 0:
+		return x.Value, DefaultRoute
+	}
+	return x.Value, LongerPrefix
 }
 
 // Leaf returns true is r is an leaf node, when false is returned
@@ -50,17 +211,211 @@ func (r *Radix32) Leaf() bool {
 	return r.branch[0] == nil && r.branch[1] == nil
 }
 
+// Branch returns the child of r for the given bit value, 0 or 1. It returns nil
+// when there is no such child. Together with BitK32 this allows custom walks
+// of the tree, the child to take at depth d is Branch(BitK32(n, 31-d)).
+func (r *Radix32) Branch(bit byte) *Radix32 {
+	if bit > 1 {
+		return nil
+	}
+	return r.branch[bit]
+}
+
 // Insert inserts a new value n in the tree r. The first bits bits of n are significant
-// and used to store the value v.
+// and used to store the value v, the other bits of n are masked off.
 // It returns the inserted node, r must be the root of the tree.
+// In a tree created with NewCanonical32 nothing is inserted and nil is returned
+// when n has bits set beyond its first bits bits, use TryInsert to get the error.
+// Insert panics when bits is negative or larger than the width of the tree,
+// as that is a bug in the caller; TryInsert returns ErrPrefixLen instead.
+// Like all methods, Insert assumes n is in the intended bit order, the most
+// significant bit first, as binary.BigEndian.Uint32 returns for an IPv4
+// address; see InsertHostOrder for keys in host byte order.
 func (r *Radix32) Insert(n uint32, bits int, v uint32) *Radix32 {
-	return r.insert(n, bits, v, bitSize32-1)
+	r1, err := r.TryInsert(n, bits, v)
+	if err == ErrPrefixLen {
+		panic(err)
+	}
+	return r1
+}
+
+// TryInsert works like Insert, but returns ErrHostBits when r is in canonical
+// mode and n is not canonical, see IsCanonical32, and ErrPrefixLen when bits
+// is out of range.
+func (r *Radix32) TryInsert(n uint32, bits int, v uint32) (*Radix32, error) {
+	n, err := r.check(n, bits)
+	if err != nil {
+		return nil, err
+	}
+	if r.flags&flagAggregate != 0 {
+		return r.insertAggregate(n, bits, v), nil
+	}
+	return r.insert(n, bits, v, bitSize32-1), nil
+}
+
+// GetOrInsert returns the node storing the first bits bits of n when it is in
+// the tree, and false. Otherwise it inserts the value v like Insert does and
+// returns the new node and true. The key is checked like Insert does first:
+// when a tree created with NewCanonical32 rejects n, nil and false are
+// returned, so a nil node must not be taken for a key already present.
+// r must be the root of the tree.
+func (r *Radix32) GetOrInsert(n uint32, bits int, v uint32) (*Radix32, bool) {
+	n, err := r.check(n, bits)
+	if err == ErrPrefixLen {
+		panic(err)
+	}
+	if err != nil {
+		return nil, false
+	}
+	if x := r.exact(n, bits); x != nil {
+		return x, false
+	}
+	return r.Insert(n, bits, v), true
+}
+
+// Upsert inserts the value f returns for the first bits bits of n, like Insert
+// does, in a single walk down the tree. f is called with the value stored under
+// the key and true when the key is in the tree, and with 0 and false otherwise.
+// f is not called when Insert would reject the key. r must be the root of the tree.
+func (r *Radix32) Upsert(n uint32, bits int, f func(old uint32, existed bool) uint32) *Radix32 {
+	n, err := r.check(n, bits)
+	if err == ErrPrefixLen {
+		panic(err)
+	}
+	if err != nil {
+		return nil
+	}
+	if r.flags&flagAggregate != 0 {
+		// merging siblings needs the new value up front
+		if x := r.exact(n, bits); x != nil {
+			return r.insertAggregate(n, bits, f(x.Value, true))
+		}
+		return r.insertAggregate(n, bits, f(0, false))
+	}
+	return r.insertFunc(n, bits, 0, f, bitSize32-1)
+}
+
+// Check if the first bits bits of n can be inserted in the tree r, as done by
+// TryInsert, and return n with the other bits masked off.
+func (r *Radix32) check(n uint32, bits int) (uint32, error) {
+	if bits < 0 || bits > r.Width() {
+		return 0, ErrPrefixLen
+	}
+	if !IsCanonical32(n, bits) {
+		if r.flags&flagCanonical != 0 {
+			return 0, ErrHostBits
+		}
+		n &= bitMask32(bits)
+	}
+	return n, nil
+}
+
+// IsCanonical32 returns true when n has no bits set beyond its first bits bits.
+func IsCanonical32(n uint32, bits int) bool {
+	return n&^bitMask32(bits) == 0
 }
 
 // Remove removes a value from the tree r. It returns the node removed, or nil
 // when nothing is found. r must be the root of the tree.
 func (r *Radix32) Remove(n uint32, bits int) *Radix32 {
-	return r.remove(n, bits, bitSize32-1)
+	x := r.exact(n, bits)
+	if x == nil {
+		return nil
+	}
+	r1 := &Radix32{[2]*Radix32{nil, nil}, nil, x.seq, x.key, x.Value, x.bits, 0, 0}
+	x.clear()
+	x.prune()
+	return r1
+}
+
+// RemoveWhere removes all keys for which pred returns true from the tree r,
+// and returns the number of keys removed. r must be the root of the tree.
+func (r *Radix32) RemoveWhere(pred func(key, value uint32, bits int) bool) int {
+	count := 0
+	r.removeWhere(pred, &count)
+	return count
+}
+
+// Move moves the value stored under the first fromBits bits of fromKey to the
+// first toBits bits of toKey. It returns false when the source is not found, or
+// when the destination would not be accepted by Insert, in which case the tree
+// is not changed. r must be the root of the tree.
+func (r *Radix32) Move(fromKey uint32, fromBits int, toKey uint32, toBits int) bool {
+	if _, err := r.check(toKey, toBits); err != nil {
+		return false
+	}
+	x := r.Remove(fromKey, fromBits)
+	if x == nil {
+		return false
+	}
+	r.Insert(toKey, toBits, x.Value)
+	return true
+}
+
+// Apply applies the operations in ops to the tree r, all or nothing: when an
+// operation is invalid an error is returned and the tree is left unchanged.
+// The operations are checked against the tree first and then applied in place.
+// In an aggregating tree an insert may merge or split other keys, so there the
+// operations are applied to a copy of the tree, which then replaces the contents
+// of r: nodes of r returned before, other than r itself, are no longer part of
+// the tree. r must be the root of the tree.
+func (r *Radix32) Apply(ops []Op32) error {
+	if r.flags&flagAggregate != 0 {
+		t := r.copy(nil)
+		if err := t.apply(ops); err != nil {
+			return err
+		}
+		r.replace(t)
+		return nil
+	}
+	// Keys inserted or removed by earlier operations
+	added := make(map[prefix32]bool)
+	stored := func(n uint32, bits int) bool {
+		if a, ok := added[prefix32{n & bitMask32(bits), uint8(bits)}]; ok {
+			return a
+		}
+		return r.exact(n, bits) != nil
+	}
+	for i, op := range ops {
+		if op.Bits < 0 || op.Bits > r.Width() {
+			return fmt.Errorf("bitradix: op %d: %w", i, ErrPrefixLen)
+		}
+		switch op.Kind {
+		case OpInsert:
+			if _, err := r.check(op.Key, op.Bits); err != nil {
+				return fmt.Errorf("bitradix: op %d: %w", i, err)
+			}
+			added[prefix32{op.Key & bitMask32(op.Bits), uint8(op.Bits)}] = true
+		case OpRemove:
+			if !stored(op.Key, op.Bits) {
+				return fmt.Errorf("bitradix: op %d: %w", i, ErrNotFound)
+			}
+			added[prefix32{op.Key & bitMask32(op.Bits), uint8(op.Bits)}] = false
+		case OpUpdate:
+			if !stored(op.Key, op.Bits) {
+				return fmt.Errorf("bitradix: op %d: %w", i, ErrNotFound)
+			}
+		default:
+			return fmt.Errorf("bitradix: op %d: unknown kind %d", i, op.Kind)
+		}
+	}
+	return r.apply(ops)
+}
+
+// Load replaces the contents of the tree r with the entries in e, inserted in
+// order as Insert does, so a later entry for the same key wins. The mode of
+// the tree, canonical or aggregating, and its width are kept. The new contents
+// are built in new nodes, the old nodes are not reused; when an entry makes
+// Insert panic, r is left unchanged. Only the root is kept, so r stays valid,
+// but other nodes of r returned before are no longer part of the tree.
+// r must be the root of the tree.
+func (r *Radix32) Load(e []Entry32) {
+	t := New32()
+	t.setMode(r)
+	for _, e1 := range e {
+		t.Insert(e1.Key, e1.Bits, e1.Value)
+	}
+	r.replace(t)
 }
 
 // Find searches the tree for the key n, where the first bits bits of n 
@@ -69,6 +424,249 @@ func (r *Radix32) Find(n uint32, bits int) *Radix32 {
 	return r.find(n, bits, bitSize32-1, nil)
 }
 
+// FindOrError does a longest prefix match for n like Find. When no key covers
+// n, it returns an error wrapping ErrNotFound that names the deepest key on
+// the path of n and the bit, counted from the most significant bit, at which
+// that key and n diverge. r must be the root of the tree.
+func (r *Radix32) FindOrError(n uint32) (*Radix32, error) {
+	if x := r.Find(n, bitSize32); x != nil {
+		return x, nil
+	}
+	var last *Radix32
+	for x, bit := r, bitSize32-1; x != nil; bit-- {
+		if x.set() {
+			last = x
+		}
+		if x.Leaf() || bit < 0 {
+			break
+		}
+		x = x.branch[bitK32(n, bit)]
+	}
+	if last == nil {
+		return nil, fmt.Errorf("bitradix: no covering prefix for %s; no partial match: %w", ip32(n), ErrNotFound)
+	}
+	return nil, fmt.Errorf("bitradix: no covering prefix for %s; deepest partial match was %s/%d diverging at bit %d: %w",
+		ip32(n), ip32(last.key), last.bits, commonBits32(n, last.key), ErrNotFound)
+}
+
+// InsertHostOrder works like Insert, but takes n in host byte order, as read
+// from the bytes of an address with binary.NativeEndian.Uint32, and converts it
+// to network byte order first.
+func (r *Radix32) InsertHostOrder(n uint32, bits int, v uint32) *Radix32 {
+	return r.Insert(networkOrder32(n), bits, v)
+}
+
+// FindHostOrder works like Find, but takes n in host byte order, see
+// InsertHostOrder.
+func (r *Radix32) FindHostOrder(n uint32, bits int) *Radix32 {
+	return r.Find(networkOrder32(n), bits)
+}
+
+// PreviewInsert reports what Insert(n, bits, v) would change in the tree r,
+// without modifying the tree. When the key is already stored with the value v,
+// both New and Overwrite are false. r must be the root of the tree.
+func (r *Radix32) PreviewInsert(n uint32, bits int, v uint32) InsertImpact {
+	n &= bitMask32(bits)
+	i := InsertImpact{New: true}
+	if x := r.exact(n, bits); x != nil {
+		i.New = false
+		i.Overwrite = x.Value != v
+		i.Old = x.Value
+	}
+	r.within(n, bits, func(r1 *Radix32) bool {
+		if int(r1.bits) > bits {
+			i.Shadowed++
+		}
+		return true
+	})
+	return i
+}
+
+// Intersecting returns all keys in the tree r that intersect with the first
+// bits bits of n: the less-specific keys containing n, the key itself and the
+// more-specific keys contained in n. The keys are returned in order.
+// r must be the root of the tree.
+func (r *Radix32) Intersecting(n uint32, bits int) []*Radix32 {
+	n &= bitMask32(bits)
+	s := make([]*Radix32, 0)
+	for x, bit := r, bitSize32-1; x != nil && bitSize32-1-bit < bits; bit-- {
+		if m := bitMask32(int(x.bits)); x.set() && int(x.bits) < bits && x.key&m == n&m {
+			s = append(s, x)
+		}
+		if x.Leaf() {
+			break
+		}
+		x = x.branch[bitK32(n, bit)]
+	}
+	r.within(n, bits, func(r1 *Radix32) bool {
+		s = append(s, r1)
+		return true
+	})
+	return s
+}
+
+// LookupWithChildren returns the longest prefix match for n, together with
+// the keys directly nested under it: the more-specific keys that are not
+// nested under another more-specific key. r must be the root of the tree.
+func (r *Radix32) LookupWithChildren(n uint32) (match *Radix32, children []*Radix32, ok bool) {
+	match = r.Find(n, bitSize32)
+	if match == nil {
+		return nil, nil, false
+	}
+	children = make([]*Radix32, 0)
+	for _, b := range match.branch {
+		if b != nil {
+			b.nearest(&children)
+		}
+	}
+	return match, children, true
+}
+
+// FindReversed does a longest prefix match for n with its bits reversed, for
+// trees that store keys bit-reversed: the least significant bit of an ID is the
+// most significant bit of its key, as some Kademlia implementations do.
+// Callers can then look up with the natural ID. It returns the node found and
+// its number of significant bits, or nil and 0. r must be the root of the tree.
+func (r *Radix32) FindReversed(n uint32) (*Radix32, int) {
+	x := r.Find(bits.Reverse32(n), bitSize32)
+	if x == nil {
+		return nil, 0
+	}
+	return x, int(x.bits)
+}
+
+// LookupRange does a longest prefix match for n and returns the first and the
+// last address of the key matched, together with its value. When nothing
+// matches ok is false. r must be the root of the tree.
+func (r *Radix32) LookupRange(n uint32) (start, end uint32, value uint32, ok bool) {
+	x := r.Find(n, bitSize32)
+	if x == nil {
+		return 0, 0, 0, false
+	}
+	m := bitMask32(int(x.bits))
+	return x.key & m, x.key | ^m, x.Value, true
+}
+
+// RPFCheck performs a reverse path forwarding check: it returns true when the
+// value of the longest prefix match for src, interpreted as an interface id,
+// equals expectedIface. r must be the root of the tree.
+func (r *Radix32) RPFCheck(src uint32, expectedIface uint32) bool {
+	x := r.Find(src, bitSize32)
+	return x != nil && x.Value == expectedIface
+}
+
+// LookupCost returns the number of nodes a longest prefix match for n visits,
+// including the root node. The lookup follows the path of n until it ends in a
+// leaf node or a missing branch, so the cost is the length of that path plus
+// one, at most 33. It does not depend on the key matched: more-specific keys
+// close to n make the path, and the cost, longer. r must be the root of the tree.
+func (r *Radix32) LookupCost(n uint32) int {
+	c := 0
+	for x, bit := r, bitSize32-1; x != nil; bit-- {
+		c++
+		if x.Leaf() || bit < 0 {
+			break
+		}
+		x = x.branch[bitK32(n, bit)]
+	}
+	return c
+}
+
+// PrefixesInRange returns the keys in the tree r, in order, whose range of
+// addresses intersects the range lo to hi, inclusive.
+func (r *Radix32) PrefixesInRange(lo, hi uint32) []*Radix32 {
+	s := make([]*Radix32, 0)
+	if lo <= hi {
+		r.inRange(lo, hi, 0, 0, &s)
+	}
+	return s
+}
+
+// CommonAncestor returns the lowest common ancestor of the nodes storing the
+// keys a and b. When one of the nodes is an ancestor of the other, that node
+// is returned. If either key is not stored in the tree, false is returned.
+// r must be the root of the tree.
+func (r *Radix32) CommonAncestor(a, b uint32) (*Radix32, bool) {
+	ra, rb := r.lookup(a), r.lookup(b)
+	if ra == nil || rb == nil {
+		return nil, false
+	}
+	da, db := ra.depth(), rb.depth()
+	for ; da > db; da-- {
+		ra = ra.parent
+	}
+	for ; db > da; db-- {
+		rb = rb.parent
+	}
+	for ra != rb {
+		ra, rb = ra.parent, rb.parent
+	}
+	return ra, true
+}
+
+// LongestUncoveredPrefix returns the shortest prefix containing n that is not
+// stored in the tree and does not contain any stored key; the free block n
+// falls into. If n itself is stored with 32 bits there is no such block
+// and -1 is returned for the number of bits. r must be the root of the tree.
+func (r *Radix32) LongestUncoveredPrefix(n uint32) (uint32, int) {
+	x, bit := r, bitSize32-1
+	for {
+		d := bitSize32 - 1 - bit
+		if x == nil || (x.Leaf() && !x.set()) {
+			return n & bitMask32(d), d
+		}
+		if x.Leaf() {
+			// The block is free one bit after n and the key part ways
+			c := commonBits32(n, x.key)
+			if c > int(x.bits) {
+				c = int(x.bits)
+			}
+			if c == bitSize32 {
+				return 0, -1
+			}
+			return n & bitMask32(c+1), c + 1
+		}
+		x = x.branch[bitK32(n, bit)]
+		bit--
+	}
+}
+
+// AllocateAligned finds the first prefix of bits bits inside the first
+// withinBits bits of within that does not intersect any key stored in the
+// tree, other than keys containing the parent prefix itself. The prefix found is
+// reserved by inserting it with value 0 and returned. As the prefix is a key of
+// bits bits it is always aligned on its own size. When there is no free prefix
+// false is returned. In a tree created with NewAutoAggregate32 reservations
+// would merge into their parent prefix, so false is always returned there.
+// r must be the root of the tree.
+func (r *Radix32) AllocateAligned(bits int, within uint32, withinBits int) (uint32, bool) {
+	if r.flags&flagAggregate != 0 || withinBits < 0 || bits < withinBits || bits > r.Width() {
+		return 0, false
+	}
+	within &= bitMask32(withinBits)
+	last := uint64(within | ^bitMask32(withinBits))
+	size := uint64(1) << uint(bitSize32-bits)
+	for n := uint64(within); n <= last; {
+		free, end := true, n+size-1
+		for _, x := range r.Intersecting(uint32(n), bits) {
+			if int(x.bits) <= withinBits {
+				continue
+			}
+			free = false
+			// Skip over a less-specific key as a whole
+			if e := uint64(x.key | ^bitMask32(int(x.bits))); e > end {
+				end = e
+			}
+		}
+		if free {
+			r.Insert(uint32(n), bits, 0)
+			return uint32(n), true
+		}
+		n = end + 1
+	}
+	return 0, false
+}
+
 // Do traverses the tree r in breadth-first order. For each visited node,
 // the function f is called with the current node, the level of the node
 // (starting with 0 for the root), and the branch taken
@@ -91,16 +689,362 @@ func (r *Radix32) Do(f func(*Radix32, int, int)) {
 	}
 }
 
-// Implement insert
+// DoLimited traverses the tree r depth-first, visiting a node before its zero
+// and one branch, and calls f with each node and its depth, starting with 0
+// for r. Nodes deeper than maxDepth are not visited. The walk stops when f
+// returns false.
+func (r *Radix32) DoLimited(maxDepth int, f func(*Radix32, int) bool) {
+	r.doLimited(0, maxDepth, f)
+}
+
+// DoOrdered calls f for each key in order that is stored in the tree r, keys
+// that are not found are skipped. When a key is stored with different
+// numbers of significant bits, the most specific node is used.
+func (r *Radix32) DoOrdered(order []uint32, f func(*Radix32)) {
+	for _, n := range order {
+		if r1 := r.lookup(n); r1 != nil {
+			f(r1)
+		}
+	}
+}
+
+// Len returns the number of keys stored in the tree r.
+func (r *Radix32) Len() int {
+	i := 0
+	r.walk(func(*Radix32) bool {
+		i++
+		return true
+	})
+	return i
+}
+
+// MaxPrefixLen returns the largest number of significant bits of the keys in
+// the tree r, or 0 when the tree is empty.
+func (r *Radix32) MaxPrefixLen() int {
+	m := 0
+	r.walk(func(r1 *Radix32) bool {
+		if int(r1.bits) > m {
+			m = int(r1.bits)
+		}
+		return m < bitSize32
+	})
+	return m
+}
+
+// Skew returns how lopsided the tree r is, as |L-R| / (L+R), where L and R
+// are the number of keys below the zero and the one branch of the root.
+// It returns 0 for a balanced tree and 1 when all keys are on one side.
+func (r *Radix32) Skew() float64 {
+	var c [2]int
+	for i, b := range r.branch {
+		if b != nil {
+			c[i] = b.Len()
+		}
+	}
+	if c[0]+c[1] == 0 {
+		return 0
+	}
+	return math.Abs(float64(c[0]-c[1])) / float64(c[0]+c[1])
+}
+
+// TopBitHistogram returns the number of keys in the tree r in each of the
+// 2^topBits buckets selected by the first topBits bits of the key. A key with
+// fewer than topBits bits is counted in the first bucket it covers.
+// topBits must be between 0 and 16, otherwise nil is returned.
+func (r *Radix32) TopBitHistogram(topBits int) []int {
+	if topBits < 0 || topBits > 16 {
+		return nil
+	}
+	h := make([]int, 1<<uint(topBits))
+	r.walk(func(r1 *Radix32) bool {
+		h[uint64(r1.key)>>uint(bitSize32-topBits)]++
+		return true
+	})
+	return h
+}
+
+// Keys returns the keys stored in the tree r in order.
+func (r *Radix32) Keys() []uint32 {
+	k := make([]uint32, r.Len())
+	i := 0
+	r.walk(func(r1 *Radix32) bool {
+		k[i] = r1.key
+		i++
+		return true
+	})
+	return k
+}
+
+// IsValidRIB checks if the tree r is usable as a routing table, meaning no key
+// has bits set beyond its prefix length. The error returned wraps ErrHostBits
+// and names the first offending key. As Insert masks off the host bits, this
+// can only fail when the internal invariants of the tree are broken; it is a
+// sanity check, not a way to find malformed input, see NewCanonical32 for that.
+func (r *Radix32) IsValidRIB() error {
+	var err error
+	r.walk(func(r1 *Radix32) bool {
+		if !IsCanonical32(r1.key, int(r1.bits)) {
+			err = fmt.Errorf("%w: %s/%d", ErrHostBits, ip32(r1.key), r1.bits)
+			return false
+		}
+		return true
+	})
+	return err
+}
+
+// IsValidRIBWithDefault works like IsValidRIB, but also returns ErrNoDefault when
+// the tree r does not have a default route.
+func (r *Radix32) IsValidRIBWithDefault() error {
+	if err := r.IsValidRIB(); err != nil {
+		return err
+	}
+	if r.flags&flagDefault == 0 {
+		return ErrNoDefault
+	}
+	return nil
+}
+
+// Mark returns a marker for the current point in time. Keys that are
+// inserted (or overwritten) after this point are visited by Since.
+func (r *Radix32) Mark() Marker {
+	return Marker{atomic.LoadUint64(&seq32)}
+}
+
+// Since calls f in key order for each key in the tree r that was inserted
+// after the marker m was created.
+func (r *Radix32) Since(m Marker, f func(*Radix32)) {
+	r.walk(func(r1 *Radix32) bool {
+		if r1.seq > m.seq {
+			f(r1)
+		}
+		return true
+	})
+}
+
+// CoverageFraction returns the fraction of all 2^32 keys that is covered by the
+// keys stored in the tree r. Keys covered by more than one stored key are
+// counted once.
+func (r *Radix32) CoverageFraction() float64 {
+	return float64(r.covered(func(*Radix32) bool { return true })) / (1 << bitSize32)
+}
+
+// AddressCountForValue returns the number of keys covered by the stored keys
+// with value v. Keys covered by more than one of them are counted once.
+func (r *Radix32) AddressCountForValue(v uint32) uint64 {
+	return r.covered(func(r1 *Radix32) bool { return r1.Value == v })
+}
+
+// CoverageByLength returns for each number of bits used by the keys in the
+// tree r the number of keys covered by the stored keys with that many bits.
+// Stored keys of equal length never overlap, keys of different lengths may.
+func (r *Radix32) CoverageByLength() map[int]uint64 {
+	c := make(map[int]uint64)
+	r.walk(func(r1 *Radix32) bool {
+		c[int(r1.bits)] += 1 << uint(bitSize32-int(r1.bits))
+		return true
+	})
+	return c
+}
+
+// DoWithParentPrefix calls f in key order for each key in the tree r, together
+// with the nearest less-specific key that covers it, or nil if there is none.
+func (r *Radix32) DoWithParentPrefix(f func(node, coveringParent *Radix32)) {
+	r.doWithParent(nil, f)
+}
+
+// FindByValue returns the first node in key order whose value satisfies pred.
+func (r *Radix32) FindByValue(pred func(uint32) bool) (*Radix32, bool) {
+	var x *Radix32
+	r.walk(func(r1 *Radix32) bool {
+		if pred(r1.Value) {
+			x = r1
+			return false
+		}
+		return true
+	})
+	return x, x != nil
+}
+
+// ShardKey distributes the keys in the tree r over shards buckets, using a
+// stable hash of the key and its number of bits, so a key always ends up in the
+// same bucket. Each bucket holds its keys in order.
+func (r *Radix32) ShardKey(shards int) map[int][]*Radix32 {
+	m := make(map[int][]*Radix32)
+	if shards <= 0 {
+		return m
+	}
+	r.walk(func(r1 *Radix32) bool {
+		h := fnv.New32a()
+		h.Write([]byte{byte(r1.key >> 24), byte(r1.key >> 16), byte(r1.key >> 8), byte(r1.key), r1.bits})
+		i := int(h.Sum32() % uint32(shards))
+		m[i] = append(m[i], r1)
+		return true
+	})
+	return m
+}
+
+// GroupByValue returns the nodes with a key in the tree r grouped by their
+// value, each group is in key order.
+func (r *Radix32) GroupByValue() map[uint32][]*Radix32 {
+	g := make(map[uint32][]*Radix32)
+	r.walk(func(r1 *Radix32) bool {
+		g[r1.Value] = append(g[r1.Value], r1)
+		return true
+	})
+	return g
+}
+
+// Equal returns true when the trees r and other store the same keys with
+// the same values.
+func (r *Radix32) Equal(other *Radix32) bool {
+	return r.equal(other, true)
+}
+
+// EqualKeys returns true when the trees r and other store the same keys,
+// the values are not compared.
+func (r *Radix32) EqualKeys(other *Radix32) bool {
+	return r.equal(other, false)
+}
+
+// Minus returns a new tree with the keys in the tree r that are not in the
+// tree other, compared by key and bits only. The new tree has the mode and
+// width of r. r and other must be the roots of their trees.
+func (r *Radix32) Minus(other *Radix32) *Radix32 {
+	t := New32()
+	r.walk(func(r1 *Radix32) bool {
+		if other.exact(r1.key, int(r1.bits)) == nil {
+			t.Insert(r1.key, int(r1.bits), r1.Value)
+		}
+		return true
+	})
+	t.setMode(r)
+	return t
+}
+
+// OverlapsTree returns true when a key in the tree r contains or equals a key
+// in the tree other, or the other way around. Both trees are walked at the
+// same time, so only the paths the trees share are visited.
+// r and other must be the roots of their trees.
+func (r *Radix32) OverlapsTree(other *Radix32) bool {
+	return r.overlapsTree(other, bitSize32-1)
+}
+
+// StructEqual returns true when the trees r and other have the same shape and
+// every node stores the same key, bits and value. Unlike Equal this also
+// compares how the keys are laid out in the tree. Insertion sequence numbers
+// are not compared.
+func (r *Radix32) StructEqual(other *Radix32) bool {
+	if r == nil || other == nil {
+		return r == other
+	}
+	if r.key != other.key || r.bits != other.bits || r.Value != other.Value || r.set() != other.set() {
+		return false
+	}
+	return r.branch[0].StructEqual(other.branch[0]) && r.branch[1].StructEqual(other.branch[1])
+}
+
+// EachKV calls f for each key in the tree r in key order, with copies of the
+// key and the value stored. When f returns false the iteration stops.
+func (r *Radix32) EachKV(f func(key, value uint32) bool) {
+	r.walk(func(r1 *Radix32) bool { return f(r1.key, r1.Value) })
+}
+
+// Partition splits the tree r in the subtrees rooted at the given depth and
+// returns them as new trees. A leaf node above depth counts as a subtree on
+// its own, the keys stored in the non-leaf nodes above depth are returned
+// together as the first tree. The trees are copies and share no storage with r,
+// so they can be modified independently. They hold the same keys as r and
+// have the mode and width of r. r must be the root of the tree.
+func (r *Radix32) Partition(depth int) []*Radix32 {
+	top := New32()
+	p := []*Radix32{top}
+	r.partition(depth, 0, top, &p)
+	if !top.set() && top.Leaf() {
+		p = p[1:]
+	}
+	for _, t := range p {
+		t.setMode(r)
+	}
+	return p
+}
+
+// FindOverlaps returns all pairs of keys in the tree r where one key
+// contains the other.
+func (r *Radix32) FindOverlaps() []OverlapPair32 {
+	o := make([]OverlapPair32, 0)
+	r.overlaps(nil, &o)
+	return o
+}
+
+// DisjointCover returns the fewest prefixes that do not overlap and together
+// cover exactly the addresses covered by the keys in the tree r, in order.
+// Keys nested in another key are dropped and sibling prefixes are merged, so
+// the values no longer mean anything: an entry gets the value of the first
+// key it is made of. Use Minimize to keep the results of lookups instead.
+func (r *Radix32) DisjointCover() []Entry32 {
+	e := make([]Entry32, 0)
+	r.walk(func(r1 *Radix32) bool {
+		n := len(e)
+		if n > 0 && e[n-1].Bits <= int(r1.bits) && r1.key&bitMask32(e[n-1].Bits) == e[n-1].Key {
+			return true // nested in a previous prefix
+		}
+		e = append(e, Entry32{r1.key, int(r1.bits), r1.Value})
+		for n = len(e); n > 1; n = len(e) {
+			a, b := e[n-2], e[n-1]
+			if a.Bits != b.Bits || a.Bits == 0 || b.Key != a.Key|1<<uint(bitSize32-a.Bits) {
+				break
+			}
+			e = e[:n-1]
+			e[n-2].Bits--
+		}
+		return true
+	})
+	return e
+}
+
+// AggregationCandidates returns an iterator over the pairs of sibling keys in
+// the tree r, keys with the same number of bits that only differ in their last
+// bit, that store the same value and could be merged into their parent key.
+// The pairs are yielded in key order, the key ending in a zero bit first.
+// r must be the root of the tree.
+func (r *Radix32) AggregationCandidates() iter.Seq[[2]*Radix32] {
+	return func(yield func([2]*Radix32) bool) {
+		r.walk(func(r1 *Radix32) bool {
+			if r1.bits == 0 || bitK32(r1.key, bitSize32-int(r1.bits)) == 1 {
+				return true
+			}
+			s := r.exact(r1.key|1<<uint(bitSize32-int(r1.bits)), int(r1.bits))
+			if s == nil || s.Value != r1.Value {
+				return true
+			}
+			return yield([2]*Radix32{r1, s})
+		})
+	}
+}
+
+// Implement insert. A node at depth d (d = bitSize32-1-bit) stores a key of
+// exactly d bits when it is a non-leaf node, a leaf node may store a key
+// with d or more bits.
 func (r *Radix32) insert(n uint32, bits int, v uint32, bit int) *Radix32 {
+	return r.insertFunc(n, bits, v, nil, bit)
+}
+
+// Implement insert and Upsert. The value stored is v, or when f is not nil the
+// value f returns for the value already stored under the key.
+func (r *Radix32) insertFunc(n uint32, bits int, v uint32, f func(uint32, bool) uint32, bit int) *Radix32 {
 	switch r.Leaf() {
 	case false:
-		// if bitSize32-bits == bit { // seen all bits, put something here
-		if bitSize32-bits == bit { // we need to store a value here
-			// TODO(mg): check previous value?
+		if bitSize32-bits == bit+1 { // we need to store a value here
+			if f != nil {
+				v = f(r.Value, r.set())
+			}
 			r.key = n
-			r.bits = bits
+			r.bits = uint8(bits)
 			r.Value = v
+			r.seq = nextSeq32()
+			if bits == 0 {
+				r.flags |= flagDefault
+			}
 			// keep it a non-leaf
 			return r
 		}
@@ -110,64 +1054,62 @@ func (r *Radix32) insert(n uint32, bits int, v uint32, bit int) *Radix32 {
 			r.branch[k] = New32() // create missing branch
 			r.branch[k].parent = r
 		}
-		return r.branch[k].insert(n, bits, v, bit-1)
+		return r.branch[k].insertFunc(n, bits, v, f, bit-1)
 	case true:
 		// External node, (optional) key, no branches
-		if r.bits == 0 { // nothing here yet, put something in
-			r.bits = bits
+		if !r.set() { // nothing here yet, put something in
+			if f != nil {
+				v = f(0, false)
+			}
+			r.bits = uint8(bits)
 			r.key = n
 			r.Value = v
+			r.seq = nextSeq32()
+			if bits == 0 {
+				r.flags |= flagDefault
+			}
 			return r
 		}
-		if bitSize32-bits == bit { // seen all bits, put something here
-			if r.bits != 0 {
-				// println("something here ALREADY")
+		mask := bitMask32(bits)
+		if int(r.bits) == bits && r.key&mask == n&mask { // same key, overwrite
+			if f != nil {
+				v = f(r.Value, true)
 			}
-			r.bits = bits
 			r.key = n
 			r.Value = v
+			r.seq = nextSeq32()
 			return r
 		}
 
-		bcur := bitK32(r.key, bit)
-		bnew := bitK32(n, bit)
-
-		switch x := bitSize32 - r.bits; true {
-		case x == bit: // current node needs to stay here
+		switch x := bitSize32 - int(r.bits); true {
+		case x == bit+1: // current node needs to stay here
 			// put new stuff in the branch below
+			if f != nil {
+				v = f(0, false)
+			}
+			bnew := bitK32(n, bit)
 			r.branch[bnew] = New32()
 			r.branch[bnew].parent = r
 			r.branch[bnew].key = n
 			r.branch[bnew].Value = v
-			r.branch[bnew].bits = bits
+			r.branch[bnew].bits = uint8(bits)
+			r.branch[bnew].seq = nextSeq32()
 			return r.branch[bnew]
-		case x < bit: // current node can be put one level down
+		case x < bit+1: // current node can be put one level down
+			bcur := bitK32(r.key, bit)
 			r.branch[bcur] = New32()
 			r.branch[bcur].parent = r
-			if bcur == bnew {
-				// "fill" the correct node, with the current key - and call ourselves
-				r.branch[bcur].key = r.key
-				r.branch[bcur].Value = r.Value
-				r.branch[bcur].bits = r.bits
-				r.bits = 0
-				r.key = 0
-				r.Value = 0
-				return r.branch[bnew].insert(n, bits, v, bit-1)
-			}
-			r.branch[bnew] = New32()
-			r.branch[bnew].parent = r
-			// bcur = 0, bnew == 1 or vice versa
 			r.branch[bcur].key = r.key
 			r.branch[bcur].Value = r.Value
 			r.branch[bcur].bits = r.bits
-			r.branch[bnew].key = n
-			r.branch[bnew].Value = v
-			r.branch[bnew].bits = bits
+			r.branch[bcur].seq = r.seq
 			r.key = 0
 			r.Value = 0
 			r.bits = 0
-			return r.branch[bnew]
-		case x > bit: // node is at the wrong spot
+			r.seq = 0
+			// we are a non-leaf node now, try again
+			return r.insertFunc(n, bits, v, f, bit)
+		case x > bit+1: // node is at the wrong spot
 			panic("bitradix: node put too far down")
 		}
 
@@ -175,129 +1117,478 @@ func (r *Radix32) insert(n uint32, bits int, v uint32, bit int) *Radix32 {
 	panic("bitradix: not reached")
 }
 
-// Walk the tree searching for n, keep the last node that has a key in tow.
-// This is the node we should retreat to when we find and delete our node.
-func (r *Radix32) remove(n uint32, bits, bit int) *Radix32 {
-	if r.bits > 0 && r.bits == bits {
-		// possible hit
-		mask := uint32(mask32 << uint(r.bits))
-		if r.key&mask == n&mask {
-			// save r in r1
-			r1 := &Radix32{[2]*Radix32{nil, nil}, nil, r.key, r.bits, r.Value}
-			r.prune(true)
-			return r1
+// Insert n in an aggregating tree. A key covering n is split in the siblings
+// along the path to n, siblings that are already stored keep their value.
+// Then n is inserted and merged with its sibling as long as they have the
+// same value, and their parent key is not stored with another value.
+func (r *Radix32) insertAggregate(n uint32, bits int, v uint32) *Radix32 {
+	if a := r.Find(n, bits); a != nil && int(a.bits) < bits {
+		ab, av := int(a.bits), a.Value
+		r.Remove(a.key, ab)
+		for l := ab + 1; l <= bits; l++ {
+			if s := (n ^ 1<<uint(bitSize32-l)) & bitMask32(l); r.exact(s, l) == nil {
+				r.insert(s, l, av, bitSize32-1)
+			}
 		}
 	}
-	k := bitK32(n, bit)
-	println(k)
-	if r.Leaf() || r.branch[k] == nil { // dead end
-		println("Dead end", n)
-		return nil
+	x := r.insert(n, bits, v, bitSize32-1)
+	for ; bits > 0; bits-- {
+		s := n ^ 1<<uint(bitSize32-bits)
+		if y := r.exact(s, bits); y == nil || y.Value != v {
+			break
+		}
+		p := n & bitMask32(bits-1)
+		if y := r.exact(p, bits-1); y != nil && y.Value != v {
+			break
+		}
+		r.Remove(n, bits)
+		r.Remove(s, bits)
+		n = p
+		x = r.insert(n, bits-1, v, bitSize32-1)
 	}
-	return r.branch[bitK32(n, bit)].remove(n, bits, bit-1)
+	return x
 }
 
-// Prune the tree
-func (r *Radix32) prune(b bool) {
-	println("Called")
-	if b {
-		println("NUKING")
-		if r.parent == nil {
-			// root node
-			r.bits = 0
-			r.key = 0
-			r.Value = 0
-			println("PARENT NUL")
+// Clear the key stored in r.
+func (r *Radix32) clear() {
+	r.key = 0
+	r.bits = 0
+	r.Value = 0
+	r.seq = 0
+	r.flags &^= flagDefault
+}
+
+// Prune the tree after the key in r has been removed, working our way up
+// to the root as long as nodes can be removed or merged. A node that keeps its
+// key but became a leaf may be merged into the nodes above it, so we continue
+// past it.
+func (r *Radix32) prune() {
+	for x := r; x != nil; x = x.parent {
+		if !x.collapse() && !x.Leaf() {
 			return
 		}
-		// we are a node, we have a parent, so the parent is 
-		// a non-leaf node
+	}
+}
+
+// Remove r from its parent when it is an empty leaf node, or move the only
+// child of r into r when that child is a leaf node. Returns true when the
+// tree was changed.
+func (r *Radix32) collapse() bool {
+	if r.set() {
+		return false
+	}
+	b0, b1 := r.branch[0], r.branch[1]
+	switch {
+	case b0 == nil && b1 == nil:
+		if r.parent == nil {
+			return false
+		}
+		// kill the branch
 		if r.parent.branch[0] == r {
-			// kill the branch
-			println("Killing 0", r)
 			r.parent.branch[0] = nil
-		}
-		if r.parent.branch[1] == r {
-			println("Killing 1", r)
+		} else {
 			r.parent.branch[1] = nil
 		}
-		r.parent.prune(false)
-		return
+		return true
+	case b0 != nil && b1 != nil:
+		// two branches, we cannot replace ourselves with a child
+		return false
+	}
+	c := b0
+	if c == nil {
+		c = b1
+	}
+	if !c.Leaf() {
+		return false
 	}
-	if r == nil {
+	// move the child into this node
+	r.key = c.key
+	r.bits = c.bits
+	r.Value = c.Value
+	r.seq = c.seq
+	r.branch[0] = nil
+	r.branch[1] = nil
+	return true
+}
+
+// Remove the keys for which pred returns true from the tree below r, pruning
+// on the way back up. The number of keys removed is added to count.
+func (r *Radix32) removeWhere(pred func(key, value uint32, bits int) bool, count *int) {
+	for _, b := range r.branch {
+		if b != nil {
+			b.removeWhere(pred, count)
+		}
+	}
+	if r.set() && pred(r.key, r.Value, int(r.bits)) {
+		r.clear()
+		*count++
+	}
+	r.collapse()
+}
+
+// Search the tree, when "seeing" a node with a key that matches n, store that
+// node, when we don't find anything within the allowed bit bits
+// we return that one.
+func (r *Radix32) find(n uint32, bits, bit int, last *Radix32) *Radix32 {
+	if r.set() && int(r.bits) <= bits {
+		mask := bitMask32(int(r.bits))
+		if r.key&mask == n&mask {
+			last = r
+		}
+	}
+	if r.Leaf() || bit < 0 {
+		return last
+	}
+	k := bitK32(n, bit)
+	if r.branch[k] == nil {
+		return last
+	}
+	return r.branch[k].find(n, bits, bit-1, last)
+}
+
+// Copy the subtrees at depth into new trees and append them to p, keys found
+// above depth are inserted in top.
+func (r *Radix32) partition(depth, d int, top *Radix32, p *[]*Radix32) {
+	if d >= depth || r.Leaf() {
+		t := New32()
+		r.walk(func(r1 *Radix32) bool {
+			t.Insert(r1.key, int(r1.bits), r1.Value)
+			return true
+		})
+		if t.set() || !t.Leaf() {
+			*p = append(*p, t)
+		}
 		return
 	}
-	if r.bits != 0 {
-		// fun stops
-		println("bitsi fuck", r.bits, r.Value)
+	if r.set() {
+		top.Insert(r.key, int(r.bits), r.Value)
+	}
+	for _, b := range r.branch {
+		if b != nil {
+			b.partition(depth, d+1, top, p)
+		}
+	}
+}
+
+// Pair each key with the keys in its ancestors, the keys in the ancestors
+// are kept in stack.
+func (r *Radix32) overlaps(stack []*Radix32, o *[]OverlapPair32) {
+	if r.set() {
+		for _, s := range stack {
+			*o = append(*o, OverlapPair32{s, r})
+		}
+		stack = append(stack, r)
+	}
+	for _, b := range r.branch {
+		if b != nil {
+			b.overlaps(stack, o)
+		}
+	}
+}
+
+// Return the number of keys covered by the stored keys in the tree below r
+// for which f returns true.
+func (r *Radix32) covered(f func(*Radix32) bool) uint64 {
+	if r.set() && f(r) {
+		return 1 << uint(bitSize32-int(r.bits))
+	}
+	c := uint64(0)
+	for _, b := range r.branch {
+		if b != nil {
+			c += b.covered(f)
+		}
+	}
+	return c
+}
+
+// Implement DoWithParentPrefix, p is the nearest ancestor of r with a key.
+func (r *Radix32) doWithParent(p *Radix32, f func(node, coveringParent *Radix32)) {
+	if r.set() {
+		f(r, p)
+		p = r
+	}
+	for _, b := range r.branch {
+		if b != nil {
+			b.doWithParent(p, f)
+		}
+	}
+}
+
+// Append the nodes with a key nearest to r, r included, to s.
+func (r *Radix32) nearest(s *[]*Radix32) {
+	if r.set() {
+		*s = append(*s, r)
 		return
 	}
-	// Does I have one or two childeren, if one, move my self up one node
-	// Also the child must be a leaf node!
-	b0 := r.branch[0]
-	b1 := r.branch[1]
-	if b0 != nil && b1 != nil {
-		println("two branches")
-		// two branches, we cannot replace ourselves with a child
+	for _, b := range r.branch {
+		if b != nil {
+			b.nearest(s)
+		}
+	}
+}
+
+// Return a deep copy of the tree below r, with parent as the parent of the copy.
+func (r *Radix32) copy(parent *Radix32) *Radix32 {
+	c := new(Radix32)
+	*c = *r
+	c.parent = parent
+	for i, b := range r.branch {
+		if b != nil {
+			c.branch[i] = b.copy(c)
+		}
+	}
+	return c
+}
+
+// Give the root r the mode and the width of the root t.
+// Call it after inserting the keys when they must be kept as they are.
+func (r *Radix32) setMode(t *Radix32) {
+	r.flags |= t.flags &^ flagDefault
+	r.width = t.width
+}
+
+// Replace the contents of the root r with those of the root t.
+func (r *Radix32) replace(t *Radix32) {
+	*r = *t
+	for _, b := range r.branch {
+		if b != nil {
+			b.parent = r
+		}
+	}
+}
+
+// Append the keys below r intersecting lo to hi to s, r is at depth and the
+// path taken to r is n.
+func (r *Radix32) inRange(lo, hi, n uint32, depth int, s *[]*Radix32) {
+	if n > hi || n|^bitMask32(depth) < lo {
 		return
 	}
-	switch b0 != nil {
-	case true:
-		if !b0.Leaf() {
-			println("NOT A LEAF 0")
-			return
+	if r.set() {
+		start := r.key & bitMask32(int(r.bits))
+		if start <= hi && start|^bitMask32(int(r.bits)) >= lo {
+			*s = append(*s, r)
 		}
-		// move b0 into this node	
-		r.key = b0.key
-		r.bits = b0.bits
-		r.Value = b0.Value
-		r.branch[0] = b0.branch[0]
-		r.branch[1] = b0.branch[1]
-	case false:
-		if !b1.Leaf() {
-			println("NOT A LEAF 1")
-			return
+	}
+	for i, b := range r.branch {
+		if b != nil {
+			b.inRange(lo, hi, n|uint32(i)<<uint(bitSize32-1-depth), depth+1, s)
 		}
-		// move b1 into this node
-		r.key = b1.key
-		r.bits = b1.bits
-		r.Value = b1.Value
-		r.branch[0] = b1.branch[0]
-		r.branch[1] = b1.branch[1]
 	}
-	r.parent.prune(false)
 }
 
-// Search the tree, when "seeing" a node with a key, store that
-// node, when we don't find anything within the allowed bit bits
-// we return that one.
-func (r *Radix32) find(n uint32, bits, bit int, last *Radix32) *Radix32 {
-	k := bitK32(n, bit)
-	switch r.Leaf() {
-	case false:
-		if r.branch[k] == nil {
-			return r
+// Implement OverlapsTree, r and o are on the same path in their trees and
+// branch on bit.
+func (r *Radix32) overlapsTree(o *Radix32, bit int) bool {
+	if r == nil || o == nil {
+		return false
+	}
+	if r.set() {
+		return o.intersects(r.key, int(r.bits), bit)
+	}
+	if o.set() {
+		return r.intersects(o.key, int(o.bits), bit)
+	}
+	return r.branch[0].overlapsTree(o.branch[0], bit-1) || r.branch[1].overlapsTree(o.branch[1], bit-1)
+}
+
+// Return true when a key in the tree below r, which branches on bit, contains
+// or is contained in the first bits bits of n.
+func (r *Radix32) intersects(n uint32, bits, bit int) bool {
+	for x := r; x != nil; bit-- {
+		if x.set() {
+			m := bitMask32(min(int(x.bits), bits))
+			if x.key&m == n&m {
+				return true
+			}
 		}
-		if r.bits != 0 {
-			// Actual key, drag it along
-			// TODO(mg): check if its THE key
-			return r.branch[k].find(n, bits, bit-1, r)
+		if x.Leaf() {
+			return false
 		}
-		return r.branch[k].find(n, bits, bit-1, last)
-	case true:
-		mask := uint32(mask32 << uint(r.bits))
-		if r.key&mask == n&mask {
-			return r
+		if bitSize32-1-bit >= bits {
+			// every key below x is within n
+			return !x.walk(func(*Radix32) bool { return false })
 		}
-		return last
+		x = x.branch[bitK32(n, bit)]
 	}
-	panic("bitradix: not reached")
+	return false
+}
+
+// Implement DoLimited, r is at depth. Returns false when the walk is stopped.
+func (r *Radix32) doLimited(depth, maxDepth int, f func(*Radix32, int) bool) bool {
+	if depth > maxDepth {
+		return true
+	}
+	if !f(r, depth) {
+		return false
+	}
+	for _, b := range r.branch {
+		if b != nil && !b.doLimited(depth+1, maxDepth, f) {
+			return false
+		}
+	}
+	return true
+}
+
+// Apply the operations in ops to the tree r, stopping at the first invalid one.
+func (r *Radix32) apply(ops []Op32) error {
+	for i, op := range ops {
+		if op.Bits < 0 || op.Bits > r.Width() {
+			return fmt.Errorf("bitradix: op %d: %w", i, ErrPrefixLen)
+		}
+		switch op.Kind {
+		case OpInsert:
+			if _, err := r.TryInsert(op.Key, op.Bits, op.Value); err != nil {
+				return fmt.Errorf("bitradix: op %d: %w", i, err)
+			}
+		case OpRemove:
+			if r.Remove(op.Key, op.Bits) == nil {
+				return fmt.Errorf("bitradix: op %d: %w", i, ErrNotFound)
+			}
+		case OpUpdate:
+			x := r.exact(op.Key, op.Bits)
+			if x == nil {
+				return fmt.Errorf("bitradix: op %d: %w", i, ErrNotFound)
+			}
+			x.Value = op.Value
+			x.seq = nextSeq32()
+		default:
+			return fmt.Errorf("bitradix: op %d: unknown kind %d", i, op.Kind)
+		}
+	}
+	return nil
+}
+
+// Implement Equal and EqualKeys, values tells if the values are compared.
+func (r *Radix32) equal(o *Radix32, values bool) bool {
+	a := make([]*Radix32, 0)
+	r.walk(func(r1 *Radix32) bool {
+		a = append(a, r1)
+		return true
+	})
+	i := 0
+	eq := o.walk(func(o1 *Radix32) bool {
+		if i >= len(a) || a[i].key != o1.key || a[i].bits != o1.bits || (values && a[i].Value != o1.Value) {
+			return false
+		}
+		i++
+		return true
+	})
+	return eq && i == len(a)
+}
+
+// Walk the tree depth-first, visiting a node before its zero and one branch,
+// and call f for each node that has a key. This visits the keys in order.
+// The walk stops when f returns false, in which case false is returned.
+func (r *Radix32) walk(f func(*Radix32) bool) bool {
+	if r.set() && !f(r) {
+		return false
+	}
+	for _, b := range r.branch {
+		if b != nil && !b.walk(f) {
+			return false
+		}
+	}
+	return true
+}
+
+// Walk the tree along the path of n and call f for each key that falls
+// within the first bits bits of n, including n itself. The walk stops when
+// f returns false, in which case false is returned.
+func (r *Radix32) within(n uint32, bits int, f func(*Radix32) bool) bool {
+	mask := bitMask32(bits)
+	x, bit := r, bitSize32-1
+	for d := 0; d < bits && !x.Leaf(); d++ {
+		x = x.branch[bitK32(n, bit)]
+		bit--
+		if x == nil {
+			return true
+		}
+	}
+	return x.walk(func(r1 *Radix32) bool {
+		if int(r1.bits) < bits || r1.key&mask != n&mask {
+			return true
+		}
+		return f(r1)
+	})
+}
+
+// Return the node that stores exactly the first bits bits of n, or nil.
+func (r *Radix32) exact(n uint32, bits int) *Radix32 {
+	if x := r.Find(n, bits); x != nil && int(x.bits) == bits {
+		return x
+	}
+	return nil
+}
+
+// Walk the tree along the path of n and return the most specific node
+// whose key equals n.
+func (r *Radix32) lookup(n uint32) *Radix32 {
+	var last *Radix32
+	for x, bit := r, bitSize32-1; x != nil; bit-- {
+		if x.set() && x.key == n {
+			last = x
+		}
+		if x.Leaf() || bit < 0 {
+			break
+		}
+		x = x.branch[bitK32(n, bit)]
+	}
+	return last
+}
+
+// Return true when r stores a key.
+func (r *Radix32) set() bool {
+	return r.bits != 0 || r.flags&flagDefault != 0
+}
+
+// Return the depth of r in the tree, the root has depth 0.
+func (r *Radix32) depth() int {
+	d := 0
+	for x := r.parent; x != nil; x = x.parent {
+		d++
+	}
+	return d
 }
 
 // From: http://stackoverflow.com/questions/2249731/how-to-get-bit-by-bit-data-from-a-integer-value-in-c
 
+// BitK32 returns bit k of n, where k = 31 is the most significant bit
+// and k = 0 the least significant bit.
+func BitK32(n uint32, k int) byte {
+	return bitK32(n, k)
+}
+
 // Return bit k from n. We count from the right, MSB left.
 // So k = 0 is the last bit on the left and k = 31 is the first bit on the right.
 func bitK32(n uint32, k int) byte {
 	return byte((n & (1 << uint(k))) >> uint(k))
 }
+
+// Return a mask with the first bits bits set.
+func bitMask32(bits int) uint32 {
+	return uint32(mask32 << uint(bitSize32-bits))
+}
+
+// Return the number of leading bits a and b have in common.
+func commonBits32(a, b uint32) int {
+	return bits.LeadingZeros32(a ^ b)
+}
+
+// Return n, in host byte order, in network byte order.
+func networkOrder32(n uint32) uint32 {
+	var b [4]byte
+	binary.NativeEndian.PutUint32(b[:], n)
+	return binary.BigEndian.Uint32(b[:])
+}
+
+// Return n as a dotted quad.
+func ip32(n uint32) string {
+	return fmt.Sprintf("%d.%d.%d.%d", byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
+
+// Sort the nodes in s in key order.
+func sortNodes32(s []*Radix32) {
+	sort.Slice(s, func(i, j int) bool {
+		return s[i].key < s[j].key || (s[i].key == s[j].key && s[i].bits < s[j].bits)
+	})
+}
@@ -1,10 +1,20 @@
 package bitradix
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
 	"net"
 	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"unsafe"
+
+	"github.com/abh/bitradix/bitradixpb"
 )
 
 var tests = map[uint32]uint32{
@@ -157,7 +167,8 @@ func TestFindIP(t *testing.T) {
 	testips := map[string]uint32{
 		"10.20.1.2/32":   20,
 		"10.22.1.2/32":   20,
-		"10.19.0.1/32":   20,
+		"10.23.0.1/32":   20,
+		"10.19.0.1/32":   10,
 		"10.21.0.1/32":   21,
 		"192.168.2.3/32": 1922,
 		"230.0.0.1/32":   0,
@@ -187,7 +198,7 @@ func TestFindIPShort(t *testing.T) {
 		"10.20.1.2/32": 20,
 		"10.19.0.1/32": 10,
 		"10.0.0.2/32":  11,
-		"10.1.0.1/32":  10,
+		"10.4.0.1/32":  10,
 	}
 
 	for ip, asn := range testips {
@@ -271,3 +282,1918 @@ func TestQueue2(t *testing.T) {
 		}
 	}
 }
+
+func TestCommonAncestor(t *testing.T) {
+	r := New32()
+	addRoute(t, r, "10.1.0.0/24", 1)
+	addRoute(t, r, "10.1.128.0/24", 2)
+	addRoute(t, r, "192.168.0.0/16", 3)
+
+	a, b := uint32(0x0A010000), uint32(0x0A018000)
+	x, ok := r.CommonAncestor(a, b)
+	if !ok {
+		t.Logf("Expected a common ancestor for %032b and %032b\n", a, b)
+		t.FailNow()
+	}
+	// The keys share 16 bits, so they diverge on bit 15
+	if bit := bitSize32 - 1 - x.depth(); bit != 15 {
+		t.Logf("Expected branch bit %d, got %d\n", 15, bit)
+		t.Fail()
+	}
+	if x.branch[0] == nil || x.branch[1] == nil {
+		t.Logf("Expected ancestor with two branches\n")
+		t.Fail()
+	}
+	if _, ok := r.CommonAncestor(a, 0x0B000000); ok {
+		t.Logf("Expected no common ancestor for absent key\n")
+		t.Fail()
+	}
+}
+
+func TestEachKV(t *testing.T) {
+	r := New32()
+	addRoute(t, r, "192.168.0.0/16", 3)
+	addRoute(t, r, "10.0.0.0/8", 1)
+	addRoute(t, r, "10.1.0.0/16", 2)
+	addRoute(t, r, "8.8.8.0/24", 4)
+
+	keys := []uint32{0x08080800, 0x0A000000, 0x0A010000, 0xC0A80000}
+	values := []uint32{4, 1, 2, 3}
+	i := 0
+	r.EachKV(func(k, v uint32) bool {
+		if i >= len(keys) || k != keys[i] || v != values[i] {
+			t.Logf("Unexpected key %032b -> %d at position %d\n", k, v, i)
+			t.Fail()
+		}
+		i++
+		return true
+	})
+	if i != len(keys) {
+		t.Logf("Expected %d keys, got %d\n", len(keys), i)
+		t.Fail()
+	}
+}
+
+func TestEachKVStop(t *testing.T) {
+	r := New32()
+	addRoute(t, r, "10.0.0.0/8", 1)
+	addRoute(t, r, "10.1.0.0/16", 2)
+	addRoute(t, r, "192.168.0.0/16", 3)
+
+	i := 0
+	r.EachKV(func(k, v uint32) bool {
+		i++
+		return i < 2
+	})
+	if i != 2 {
+		t.Logf("Expected iteration to stop after %d keys, got %d\n", 2, i)
+		t.Fail()
+	}
+}
+
+func TestLongestUncoveredPrefix(t *testing.T) {
+	r := New32()
+	if n, bits := r.LongestUncoveredPrefix(0x0A000010); n != 0 || bits != 0 {
+		t.Logf("Expected the whole space to be free, got %032b/%d\n", n, bits)
+		t.Fail()
+	}
+	addRoute(t, r, "10.0.0.0/20", 1)
+	addRoute(t, r, "10.0.32.0/19", 2)
+	addRoute(t, r, "192.168.0.0/16", 3)
+	addRoute(t, r, "192.168.1.1/32", 4)
+
+	// 10.0.16.5 falls in the gap 10.0.16.0/20
+	if n, bits := r.LongestUncoveredPrefix(0x0A001005); n != 0x0A001000 || bits != 20 {
+		t.Logf("Expected %032b/%d, got %032b/%d\n", uint32(0x0A001000), 20, n, bits)
+		t.Fail()
+	}
+	if _, bits := r.LongestUncoveredPrefix(0xC0A80101); bits != -1 {
+		t.Logf("Expected no free block for a stored /32, got /%d\n", bits)
+		t.Fail()
+	}
+}
+
+func TestInsertCanonical(t *testing.T) {
+	r := NewCanonical32()
+	if _, err := r.TryInsert(0x0A000002, 8, 10); err != ErrHostBits {
+		t.Logf("Expected %v, got %v\n", ErrHostBits, err)
+		t.Fail()
+	}
+	if x := r.Insert(0x0A000002, 8, 10); x != nil {
+		t.Logf("Expected nil, got %032b/%d\n", x.key, x.bits)
+		t.Fail()
+	}
+	if x, err := r.TryInsert(0x0A000000, 8, 10); err != nil || x.Value != 10 {
+		t.Logf("Expected canonical insert to succeed, got %v\n", err)
+		t.Fail()
+	}
+
+	r = New32()
+	x, err := r.TryInsert(0x0A000002, 8, 10)
+	if err != nil {
+		t.Logf("Expected no error, got %v\n", err)
+		t.FailNow()
+	}
+	if x.Key() != 0x0A000000 {
+		t.Logf("Expected masked key %032b, got %032b\n", uint32(0x0A000000), x.Key())
+		t.Fail()
+	}
+}
+
+func TestPartition(t *testing.T) {
+	r := New32()
+	addRoute(t, r, "10.0.0.0/8", 1)
+	addRoute(t, r, "10.1.0.0/16", 2)
+	addRoute(t, r, "10.128.0.0/16", 3)
+	addRoute(t, r, "192.168.0.0/16", 4)
+	addRoute(t, r, "192.168.1.0/24", 5)
+	addRoute(t, r, "8.8.8.0/24", 6)
+
+	want := make(map[uint32]uint32)
+	r.EachKV(func(k, v uint32) bool {
+		want[k] = v
+		return true
+	})
+	for depth := 0; depth <= 12; depth++ {
+		got := make(map[uint32]uint32)
+		for _, p := range r.Partition(depth) {
+			p.EachKV(func(k, v uint32) bool {
+				if _, ok := got[k]; ok {
+					t.Logf("Key %032b found in two partitions at depth %d\n", k, depth)
+					t.Fail()
+				}
+				got[k] = v
+				return true
+			})
+		}
+		if !reflect.DeepEqual(want, got) {
+			t.Logf("Partitions at depth %d: expected %v, got %v\n", depth, want, got)
+			t.Fail()
+		}
+	}
+	if p := r.Partition(1); len(p) != 2 {
+		t.Logf("Expected %d partitions at depth 1, got %d\n", 2, len(p))
+		t.Fail()
+	}
+}
+
+func TestFindOverlaps(t *testing.T) {
+	r := New32()
+	addRoute(t, r, "10.0.0.0/8", 1)
+	addRoute(t, r, "10.1.0.0/16", 2)
+	addRoute(t, r, "10.1.1.0/24", 3)
+	addRoute(t, r, "10.2.0.0/16", 4)
+	addRoute(t, r, "192.168.0.0/16", 5)
+
+	want := map[[2]uint32]bool{
+		{1, 2}: true,
+		{1, 3}: true,
+		{2, 3}: true,
+		{1, 4}: true,
+	}
+	o := r.FindOverlaps()
+	if len(o) != len(want) {
+		t.Logf("Expected %d overlaps, got %d\n", len(want), len(o))
+		t.Fail()
+	}
+	for _, p := range o {
+		if !want[[2]uint32{p.Less.Value, p.More.Value}] {
+			t.Logf("Unexpected overlap %032b/%d %032b/%d\n", p.Less.key, p.Less.bits, p.More.key, p.More.bits)
+			t.Fail()
+		}
+	}
+}
+
+func TestDoOrdered(t *testing.T) {
+	r := New32()
+	addRoute(t, r, "10.0.0.0/8", 1)
+	addRoute(t, r, "10.1.0.0/16", 2)
+	addRoute(t, r, "192.168.0.0/16", 3)
+
+	order := []uint32{0xC0A80000, 0x0B000000, 0x0A000000, 0x0A010000, 0x0A020000}
+	got := make([]uint32, 0)
+	r.DoOrdered(order, func(r1 *Radix32) { got = append(got, r1.Value) })
+	if want := []uint32{3, 1, 2}; !reflect.DeepEqual(want, got) {
+		t.Logf("Expected %v, got %v\n", want, got)
+		t.Fail()
+	}
+}
+
+func TestPreviewInsert(t *testing.T) {
+	r := New32()
+	addRoute(t, r, "10.0.0.0/8", 1)
+	addRoute(t, r, "10.1.0.0/16", 2)
+	addRoute(t, r, "10.2.0.0/16", 3)
+	addRoute(t, r, "10.2.1.0/24", 4)
+	addRoute(t, r, "11.0.0.0/16", 5)
+
+	tests := []struct {
+		n      uint32
+		bits   int
+		v      uint32
+		impact InsertImpact
+	}{
+		{0xC0A80000, 16, 6, InsertImpact{New: true}},                           // new
+		{0x0A010000, 16, 7, InsertImpact{Overwrite: true, Old: 2}},             // overwrite
+		{0x0A010000, 16, 2, InsertImpact{Old: 2}},                              // no-op
+		{0x0A000000, 8, 8, InsertImpact{Overwrite: true, Old: 1, Shadowed: 3}}, // overwrite and shadow
+		{0x0A000000, 7, 9, InsertImpact{New: true, Shadowed: 5}},               // new, also covers 11.0.0.0/16
+	}
+	for _, test := range tests {
+		if i := r.PreviewInsert(test.n, test.bits, test.v); i != test.impact {
+			t.Logf("Expected %+v, got %+v for %032b/%d\n", test.impact, i, test.n, test.bits)
+			t.Fail()
+		}
+	}
+	if x := r.Find(0x0A010000, 16); x.Value != 2 {
+		t.Logf("Expected PreviewInsert to leave the tree alone, got %d\n", x.Value)
+		t.Fail()
+	}
+}
+
+func TestIntersecting(t *testing.T) {
+	r := New32()
+	addRoute(t, r, "10.0.0.0/8", 1)
+	addRoute(t, r, "10.1.0.0/16", 2)
+	addRoute(t, r, "10.1.1.0/24", 3)
+	addRoute(t, r, "10.1.2.0/24", 4)
+	addRoute(t, r, "10.2.0.0/16", 5)
+	addRoute(t, r, "192.168.0.0/16", 6)
+
+	got := make([]uint32, 0)
+	for _, r1 := range r.Intersecting(0x0A010000, 16) {
+		got = append(got, r1.Value)
+	}
+	if want := []uint32{1, 2, 3, 4}; !reflect.DeepEqual(want, got) {
+		t.Logf("Expected %v, got %v\n", want, got)
+		t.Fail()
+	}
+	// 10.1.0.0/20 is not stored
+	got = got[:0]
+	for _, r1 := range r.Intersecting(0x0A010000, 20) {
+		got = append(got, r1.Value)
+	}
+	if want := []uint32{1, 2, 3, 4}; !reflect.DeepEqual(want, got) {
+		t.Logf("Expected %v, got %v\n", want, got)
+		t.Fail()
+	}
+}
+
+func TestSizeof(t *testing.T) {
+	if unsafe.Sizeof(uintptr(0)) == 8 {
+		// 40 bytes plus the 64 bit insertion sequence number
+		if s := unsafe.Sizeof(Radix32{}); s != 48 {
+			t.Logf("Expected a node size of %d bytes, got %d\n", 48, s)
+			t.Fail()
+		}
+	}
+	r := New32()
+	addRoute(t, r, "10.0.0.1/32", 1)
+	addRoute(t, r, "10.0.0.0/8", 2)
+	if x := r.Find(0x0A000001, 32); x.Bits() != 32 || x.Value != 1 {
+		t.Logf("Expected %d/%d, got %d/%d\n", 1, 32, x.Value, x.Bits())
+		t.Fail()
+	}
+	if x := r.Find(0x0A000002, 32); x.Bits() != 8 || x.Value != 2 {
+		t.Logf("Expected %d/%d, got %d/%d\n", 2, 8, x.Value, x.Bits())
+		t.Fail()
+	}
+}
+
+func TestLookupStatus(t *testing.T) {
+	r := New32()
+	if _, s := r.LookupStatus(0x0A010203); s != NoMatch {
+		t.Logf("Expected %d, got %d for an empty tree\n", NoMatch, s)
+		t.Fail()
+	}
+	addRoute(t, r, "10.0.0.0/8", 10)
+	addRoute(t, r, "10.1.2.3/32", 11)
+	if _, s := r.LookupStatus(0xC0A80001); s != NoMatch {
+		t.Logf("Expected %d, got %d\n", NoMatch, s)
+		t.Fail()
+	}
+	addRoute(t, r, "0.0.0.0/0", 1)
+
+	tests := map[uint32]struct {
+		value  uint32
+		status MatchStatus
+	}{
+		0x0A010203: {11, Exact},
+		0x0A010204: {10, LongerPrefix},
+		0xC0A80001: {1, DefaultRoute},
+	}
+	for n, test := range tests {
+		if v, s := r.LookupStatus(n); v != test.value || s != test.status {
+			t.Logf("Expected %d (%d), got %d (%d) for %032b\n", test.value, test.status, v, s, n)
+			t.Fail()
+		}
+	}
+	r.Remove(0, 0)
+	if _, s := r.LookupStatus(0xC0A80001); s != NoMatch {
+		t.Logf("Expected %d after removing the default route, got %d\n", NoMatch, s)
+		t.Fail()
+	}
+	// default route first
+	r = New32()
+	addRoute(t, r, "0.0.0.0/0", 1)
+	addRoute(t, r, "10.0.0.0/8", 10)
+	if v, s := r.LookupStatus(0x0B000000); v != 1 || s != DefaultRoute {
+		t.Logf("Expected %d (%d), got %d (%d)\n", 1, DefaultRoute, v, s)
+		t.Fail()
+	}
+}
+
+func TestRemoveWhere(t *testing.T) {
+	build := func(routes map[string]uint32) *Radix32 {
+		r := New32()
+		for s, v := range routes {
+			addRoute(t, r, s, v)
+		}
+		return r
+	}
+	keep := map[string]uint32{
+		"10.0.0.0/8":     1,
+		"10.1.0.0/16":    2,
+		"192.168.1.0/24": 3,
+	}
+	all := map[string]uint32{
+		"10.1.2.3/32":    4,
+		"10.1.2.4/32":    5,
+		"10.2.0.1/32":    6,
+		"192.168.1.1/32": 7,
+		"172.16.0.1/32":  8,
+	}
+	for s, v := range keep {
+		all[s] = v
+	}
+	r := build(all)
+	if n := r.RemoveWhere(func(k, v uint32, bits int) bool { return bits == 32 }); n != 5 {
+		t.Logf("Expected %d keys removed, got %d\n", 5, n)
+		t.Fail()
+	}
+	got := make(map[uint32]uint32)
+	r.EachKV(func(k, v uint32) bool {
+		got[k] = v
+		return true
+	})
+	want := make(map[uint32]uint32)
+	build(keep).EachKV(func(k, v uint32) bool {
+		want[k] = v
+		return true
+	})
+	if !reflect.DeepEqual(want, got) {
+		t.Logf("Expected %v, got %v\n", want, got)
+		t.Fail()
+	}
+	// Empty nodes must be pruned
+	nodes := func(r *Radix32) (i int) {
+		r.Do(func(*Radix32, int, int) { i++ })
+		return
+	}
+	if n, m := nodes(r), nodes(build(keep)); n != m {
+		t.Logf("Expected %d nodes after pruning, got %d\n", m, n)
+		t.Fail()
+	}
+}
+
+func TestMove(t *testing.T) {
+	r := New32()
+	addRoute(t, r, "10.0.0.0/8", 1)
+	addRoute(t, r, "10.1.0.0/16", 2)
+	addRoute(t, r, "192.168.0.0/16", 3)
+
+	if !r.Move(0x0A010000, 16, 0xAC100000, 12) {
+		t.Logf("Expected move to succeed\n")
+		t.Fail()
+	}
+	if x := r.Find(0x0A010000, 16); x == nil || x.Value != 1 {
+		t.Logf("Expected 10.1.0.0/16 to be gone\n")
+		t.Fail()
+	}
+	if x := r.Find(0xAC100000, 12); x == nil || x.Value != 2 || x.Bits() != 12 {
+		t.Logf("Expected 172.16.0.0/12 to have value %d\n", 2)
+		t.Fail()
+	}
+	if r.Move(0x0A010000, 16, 0xAC100000, 12) {
+		t.Logf("Expected move of an absent key to fail\n")
+		t.Fail()
+	}
+
+	// A destination longer than the width of the tree leaves it unchanged
+	r = NewWithBits32(16)
+	addRoute(t, r, "10.0.0.0/8", 1)
+	if r.Move(0x0A000000, 8, 0x0B000000, 20) {
+		t.Logf("Expected move to a /20 in a 16 bit tree to fail\n")
+		t.Fail()
+	}
+	if x := r.Find(0x0A000000, 8); x == nil || x.Value != 1 {
+		t.Logf("Expected 10.0.0.0/8 to be kept\n")
+		t.Fail()
+	}
+	if _, ok := r.AllocateAligned(20, 0x0A000000, 8); ok {
+		t.Logf("Expected no /20 to be allocated in a 16 bit tree\n")
+		t.Fail()
+	}
+}
+
+func TestKeys(t *testing.T) {
+	r := New32()
+	addRoute(t, r, "192.168.0.0/16", 1)
+	addRoute(t, r, "10.1.0.0/16", 2)
+	addRoute(t, r, "10.0.0.0/8", 3)
+	addRoute(t, r, "8.8.8.0/24", 4)
+
+	want := []uint32{0x08080800, 0x0A000000, 0x0A010000, 0xC0A80000}
+	if k := r.Keys(); !reflect.DeepEqual(want, k) {
+		t.Logf("Expected %v, got %v\n", want, k)
+		t.Fail()
+	}
+	if n := r.Len(); n != len(want) {
+		t.Logf("Expected length %d, got %d\n", len(want), n)
+		t.Fail()
+	}
+	if a := testing.AllocsPerRun(10, func() { r.Keys() }); a != 1 {
+		t.Logf("Expected %d allocation, got %.0f\n", 1, a)
+		t.Fail()
+	}
+}
+
+func BenchmarkKeys(b *testing.B) {
+	r := New32()
+	for i := uint32(0); i < 100000; i++ {
+		r.Insert(i*7919, 32, i)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.Keys()
+	}
+}
+
+func TestIsValidRIB(t *testing.T) {
+	r := New32()
+	addRoute(t, r, "10.0.0.0/8", 1)
+	addRoute(t, r, "192.168.1.0/24", 2)
+	if err := r.IsValidRIB(); err != nil {
+		t.Logf("Expected a valid table, got %v\n", err)
+		t.Fail()
+	}
+	if err := r.IsValidRIBWithDefault(); err != ErrNoDefault {
+		t.Logf("Expected %v, got %v\n", ErrNoDefault, err)
+		t.Fail()
+	}
+	addRoute(t, r, "0.0.0.0/0", 3)
+	if err := r.IsValidRIBWithDefault(); err != nil {
+		t.Logf("Expected a valid table with default route, got %v\n", err)
+		t.Fail()
+	}
+
+	// Insert masks the key, so break the invariant by hand
+	r.Find(0xC0A80100, 24).key = 0xC0A80101
+	err := r.IsValidRIB()
+	if !errors.Is(err, ErrHostBits) || !strings.Contains(err.Error(), "192.168.1.1/24") {
+		t.Logf("Expected %v for 192.168.1.1/24, got %v\n", ErrHostBits, err)
+		t.Fail()
+	}
+}
+
+func TestAutoAggregate(t *testing.T) {
+	r := NewAutoAggregate32()
+	addRoute(t, r, "10.0.0.0/9", 1)
+	addRoute(t, r, "10.128.0.0/9", 1)
+	if k := r.Keys(); len(k) != 1 {
+		t.Logf("Expected %d key, got %d\n", 1, len(k))
+		t.FailNow()
+	}
+	if x := r.Find(0x0A000000, 32); x == nil || x.Bits() != 8 || x.Value != 1 {
+		t.Logf("Expected 10.0.0.0/8 with value %d\n", 1)
+		t.Fail()
+	}
+
+	// A more-specific with another value de-aggregates the /8
+	addRoute(t, r, "10.64.0.0/10", 2)
+	for ip, asn := range map[string]uint32{"10.64.0.1/32": 2, "10.0.0.1/32": 1, "10.128.0.1/32": 1} {
+		if x := findRoute(t, r, ip); x != asn {
+			t.Logf("Expected %d, got %d for %s\n", asn, x, ip)
+			t.Fail()
+		}
+	}
+	if x := r.Find(0x0A000000, 32); x == nil || x.Bits() != 10 {
+		t.Logf("Expected 10.0.0.0/10 after de-aggregation\n")
+		t.Fail()
+	}
+	// Giving it the same value again aggregates back to the /8
+	addRoute(t, r, "10.64.0.0/10", 1)
+	if k := r.Keys(); len(k) != 1 {
+		t.Logf("Expected %d key, got %d\n", 1, len(k))
+		t.Fail()
+	}
+}
+
+// De-aggregation and merging keep the keys that are already stored.
+func TestAutoAggregateNested(t *testing.T) {
+	r := NewAutoAggregate32()
+	addRoute(t, r, "10.0.0.0/16", 2)
+	addRoute(t, r, "10.0.0.0/8", 1)
+	addRoute(t, r, "10.1.0.0/16", 1)
+	for ip, v := range map[string]uint32{"10.0.0.1/32": 2, "10.1.0.1/32": 1, "10.2.0.1/32": 1, "10.128.0.1/32": 1} {
+		if x := findRoute(t, r, ip); x != v {
+			t.Logf("Expected %d, got %d for %s\n", v, x, ip)
+			t.Fail()
+		}
+	}
+
+	r = NewAutoAggregate32()
+	addRoute(t, r, "10.0.0.0/8", 1)
+	addRoute(t, r, "10.128.0.0/9", 3)
+	addRoute(t, r, "10.0.0.0/16", 4)
+	for ip, v := range map[string]uint32{"10.0.0.1/32": 4, "10.1.0.1/32": 1, "10.64.0.1/32": 1, "10.128.0.1/32": 3} {
+		if x := findRoute(t, r, ip); x != v {
+			t.Logf("Expected %d, got %d for %s\n", v, x, ip)
+			t.Fail()
+		}
+	}
+
+	// A stored parent key with another value is not overwritten by a merge
+	r = NewAutoAggregate32()
+	addRoute(t, r, "10.0.0.0/9", 1)
+	addRoute(t, r, "10.128.0.0/9", 2)
+	addRoute(t, r, "10.0.0.0/8", 5)
+	addRoute(t, r, "10.128.0.0/9", 1)
+	if x := r.Find(0x0A000000, 8); x == nil || x.Bits() != 8 || x.Value != 5 {
+		t.Logf("Expected 10.0.0.0/8 to keep value %d\n", 5)
+		t.Fail()
+	}
+	if n := r.Len(); n != 3 {
+		t.Logf("Expected %d keys, got %d\n", 3, n)
+		t.Fail()
+	}
+}
+
+func TestLookupCost(t *testing.T) {
+	r := New32()
+	addRoute(t, r, "10.0.0.0/8", 1)
+	addRoute(t, r, "10.1.0.0/16", 2)
+	addRoute(t, r, "10.1.0.0/24", 3)
+	addRoute(t, r, "10.1.1.0/24", 4)
+
+	for ip, bits := range map[string]int{"10.1.0.1/32": 24, "10.1.1.1/32": 24, "10.1.128.1/32": 16, "10.128.0.1/32": 8} {
+		_, ipnet, _ := net.ParseCIDR(ip)
+		n, _ := ipToUint(t, ipnet)
+		if x := r.Find(n, 32); x.Bits() != bits {
+			t.Logf("Expected a /%d match for %s, got /%d\n", bits, ip, x.Bits())
+			t.Fail()
+		}
+		if c := r.LookupCost(n); c != bits+1 {
+			t.Logf("Expected cost %d for %s, got %d\n", bits+1, ip, c)
+			t.Fail()
+		}
+	}
+
+	// The path goes on past the /8 matched, down to where the /24s split
+	r = New32()
+	addRoute(t, r, "10.0.0.0/8", 1)
+	addRoute(t, r, "10.2.0.0/24", 2)
+	addRoute(t, r, "10.2.1.0/24", 3)
+	if x := r.Find(0x0A020201, 32); x.Bits() != 8 {
+		t.Logf("Expected a /%d match, got /%d\n", 8, x.Bits())
+		t.Fail()
+	}
+	if c := r.LookupCost(0x0A020201); c != 23 {
+		t.Logf("Expected cost %d, got %d\n", 23, c)
+		t.Fail()
+	}
+}
+
+func TestMinimize(t *testing.T) {
+	r := New32()
+	addRoute(t, r, "10.0.0.0/8", 1)
+	addRoute(t, r, "10.1.0.0/16", 1)
+	addRoute(t, r, "10.2.0.0/16", 2)
+	addRoute(t, r, "10.3.0.0/16", 2)
+	addRoute(t, r, "10.3.4.0/24", 3)
+	addRoute(t, r, "192.168.0.0/24", 4)
+	addRoute(t, r, "192.168.1.0/24", 4)
+	addRoute(t, r, "192.168.2.0/24", 5)
+
+	m := r.Minimize()
+	if n, o := m.Len(), r.Len(); n >= o {
+		t.Logf("Expected less than %d keys, got %d\n", o, n)
+		t.Fail()
+	}
+	lpm := func(r *Radix32, n uint32) (uint32, bool) {
+		if x := r.Find(n, 32); x != nil {
+			return x.Value, true
+		}
+		return 0, false
+	}
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 100000; i++ {
+		n := rnd.Uint32()
+		switch i % 3 {
+		case 0:
+			n = 0x0A000000 | n&0x3FFFF // 10.0.0.0/14
+		case 1:
+			n = 0xC0A80000 | n&0x3FF // 192.168.0.0/22
+		}
+		v1, ok1 := lpm(r, n)
+		v2, ok2 := lpm(m, n)
+		if v1 != v2 || ok1 != ok2 {
+			t.Logf("Expected %d (%v), got %d (%v) for %s\n", v1, ok1, v2, ok2, ip32(n))
+			t.FailNow()
+		}
+	}
+	if n := m.Len(); n != 5 {
+		t.Logf("Expected %d keys, got %d\n", 5, n)
+		t.Fail()
+	}
+}
+
+func TestSince(t *testing.T) {
+	r := New32()
+	addRoute(t, r, "10.0.0.0/8", 1)
+	addRoute(t, r, "192.168.0.0/16", 2)
+	m := r.Mark()
+	addRoute(t, r, "10.1.0.0/16", 3)
+	addRoute(t, r, "8.8.8.0/24", 4)
+	addRoute(t, r, "192.168.0.0/16", 5) // overwrite
+
+	got := make([]uint32, 0)
+	r.Since(m, func(r1 *Radix32) { got = append(got, r1.Value) })
+	if want := []uint32{4, 3, 5}; !reflect.DeepEqual(want, got) {
+		t.Logf("Expected %v, got %v\n", want, got)
+		t.Fail()
+	}
+	got = got[:0]
+	r.Since(r.Mark(), func(r1 *Radix32) { got = append(got, r1.Value) })
+	if len(got) != 0 {
+		t.Logf("Expected nothing since the last mark, got %v\n", got)
+		t.Fail()
+	}
+}
+
+func TestRPFCheck(t *testing.T) {
+	r := New32()
+	addRoute(t, r, "10.0.0.0/8", 1)
+	addRoute(t, r, "10.1.0.0/16", 2)
+
+	tests := []struct {
+		src   uint32
+		iface uint32
+		ok    bool
+	}{
+		{0x0A010203, 2, true},
+		{0x0A010203, 1, false},
+		{0x0A020203, 1, true},
+		{0xC0A80001, 1, false}, // no route
+	}
+	for _, test := range tests {
+		if ok := r.RPFCheck(test.src, test.iface); ok != test.ok {
+			t.Logf("Expected %v, got %v for %s via %d\n", test.ok, ok, ip32(test.src), test.iface)
+			t.Fail()
+		}
+	}
+}
+
+func TestProtoEntries(t *testing.T) {
+	r := New32()
+	addRoute(t, r, "0.0.0.0/0", 1)
+	addRoute(t, r, "10.0.0.0/8", 2)
+	addRoute(t, r, "10.1.0.0/16", 3)
+	addRoute(t, r, "192.168.1.0/24", 4)
+
+	e := r.ToProtoEntries()
+	if len(e) != 4 {
+		t.Logf("Expected %d entries, got %d\n", 4, len(e))
+		t.Fail()
+	}
+	r1 := New32()
+	if err := r1.FromProtoEntries(e); err != nil {
+		t.Logf("Expected no error, got %v\n", err)
+		t.Fail()
+	}
+	if !reflect.DeepEqual(e, r1.ToProtoEntries()) {
+		t.Logf("Expected %v, got %v\n", e, r1.ToProtoEntries())
+		t.Fail()
+	}
+	for ip, v := range map[string]uint32{"10.1.2.3/32": 3, "10.2.3.4/32": 2, "11.0.0.1/32": 1} {
+		if x := findRoute(t, r1, ip); x != v {
+			t.Logf("Expected %d, got %d for %s\n", v, x, ip)
+			t.Fail()
+		}
+	}
+
+	// Invalid entries from the wire are rejected and leave the tree alone
+	bad := append(r.ToProtoEntries(), &bitradixpb.ProtoEntry{Key: 0x0B000000, Bits: 40, Value: 5})
+	r1 = New32()
+	if err := r1.FromProtoEntries(bad); !errors.Is(err, ErrPrefixLen) || r1.Len() != 0 {
+		t.Logf("Expected %v and an empty tree, got %v and %d keys\n", ErrPrefixLen, err, r1.Len())
+		t.Fail()
+	}
+	r1 = NewCanonical32()
+	bad[len(bad)-1].Bits = 8
+	bad[len(bad)-1].Key = 0x0B000001
+	if err := r1.FromProtoEntries(bad); !errors.Is(err, ErrHostBits) || r1.Len() != 0 {
+		t.Logf("Expected %v and an empty tree, got %v and %d keys\n", ErrHostBits, err, r1.Len())
+		t.Fail()
+	}
+}
+
+func TestDiffStreams(t *testing.T) {
+	a := `# old table
+0.0.0.0/0 1
+10.0.0.0/8 2
+10.1.0.0/16 3
+192.168.0.0/16 4
+`
+	b := `0.0.0.0/0 1
+8.8.8.0/24 5
+10.0.0.0/8 2
+10.0.0.0/16 6
+192.168.0.0/16 7
+`
+	c, err := DiffStreams(strings.NewReader(a), strings.NewReader(b))
+	if err != nil {
+		t.Logf("Expected no error, got %v\n", err)
+		t.FailNow()
+	}
+	want := []Change32{
+		{Added, 0x08080800, 24, 0, 5},
+		{Added, 0x0A000000, 16, 0, 6},
+		{Removed, 0x0A010000, 16, 3, 0},
+		{Changed, 0xC0A80000, 16, 4, 7},
+	}
+	if !reflect.DeepEqual(want, c) {
+		t.Logf("Expected %v, got %v\n", want, c)
+		t.Fail()
+	}
+	if _, err := DiffStreams(strings.NewReader("10.0.0.0/8 1\n8.0.0.0/8 1\n"), strings.NewReader("")); err == nil {
+		t.Logf("Expected an error for an unsorted stream\n")
+		t.Fail()
+	}
+}
+
+func TestCoverageFraction(t *testing.T) {
+	r := New32()
+	if f := r.CoverageFraction(); f != 0 {
+		t.Logf("Expected %f, got %f\n", 0.0, f)
+		t.Fail()
+	}
+	addRoute(t, r, "0.0.0.0/1", 1)
+	addRoute(t, r, "10.0.0.0/8", 2) // inside the /1
+	addRoute(t, r, "128.0.0.0/2", 3)
+	if f := r.CoverageFraction(); f != 0.75 {
+		t.Logf("Expected %f, got %f\n", 0.75, f)
+		t.Fail()
+	}
+	addRoute(t, r, "0.0.0.0/0", 4)
+	if f := r.CoverageFraction(); f != 1 {
+		t.Logf("Expected %f, got %f\n", 1.0, f)
+		t.Fail()
+	}
+}
+
+func TestDoWithParentPrefix(t *testing.T) {
+	r := New32()
+	addRoute(t, r, "10.0.0.0/8", 1)
+	addRoute(t, r, "10.1.0.0/16", 2)
+	addRoute(t, r, "10.1.1.0/24", 3)
+	addRoute(t, r, "10.2.0.0/16", 4)
+	addRoute(t, r, "192.168.0.0/16", 5)
+
+	// value -> value of covering parent, 0 for none
+	want := map[uint32]uint32{1: 0, 2: 1, 3: 2, 4: 1, 5: 0}
+	got := make(map[uint32]uint32)
+	r.DoWithParentPrefix(func(n, p *Radix32) {
+		got[n.Value] = 0
+		if p != nil {
+			got[n.Value] = p.Value
+		}
+	})
+	if !reflect.DeepEqual(want, got) {
+		t.Logf("Expected %v, got %v\n", want, got)
+		t.Fail()
+	}
+}
+
+func TestStreamSorted(t *testing.T) {
+	r := New32()
+	addRoute(t, r, "192.168.0.0/16", 3)
+	addRoute(t, r, "10.1.0.0/16", 2)
+	addRoute(t, r, "10.0.0.0/8", 1)
+
+	var b bytes.Buffer
+	err := r.StreamSorted(&b, func(k uint32, bits int, v uint32) []byte {
+		return []byte(fmt.Sprintf("%08x/%d=%d;", k, bits, v))
+	})
+	if err != nil {
+		t.Logf("Expected no error, got %v\n", err)
+		t.Fail()
+	}
+	if want := "0a000000/8=1;0a010000/16=2;c0a80000/16=3;"; b.String() != want {
+		t.Logf("Expected %q, got %q\n", want, b.String())
+		t.Fail()
+	}
+
+	b.Reset()
+	r.StreamSorted(&b, FormatEntry)
+	if want := "10.0.0.0/8 1\n10.1.0.0/16 2\n192.168.0.0/16 3\n"; b.String() != want {
+		t.Logf("Expected %q, got %q\n", want, b.String())
+		t.Fail()
+	}
+}
+
+func TestLookupWithChildren(t *testing.T) {
+	r := New32()
+	addRoute(t, r, "10.0.0.0/8", 1)
+	addRoute(t, r, "10.1.0.0/16", 2)
+	addRoute(t, r, "10.1.1.0/24", 3)
+	addRoute(t, r, "10.1.2.0/24", 4)
+	addRoute(t, r, "10.1.2.128/25", 5) // nested in a child
+
+	m, c, ok := r.LookupWithChildren(0x0A018001)
+	if !ok || m.Value != 2 {
+		t.Logf("Expected a match on 10.1.0.0/16\n")
+		t.FailNow()
+	}
+	got := make([]uint32, 0)
+	for _, x := range c {
+		got = append(got, x.Value)
+	}
+	if want := []uint32{3, 4}; !reflect.DeepEqual(want, got) {
+		t.Logf("Expected %v, got %v\n", want, got)
+		t.Fail()
+	}
+	if _, _, ok := r.LookupWithChildren(0xC0A80001); ok {
+		t.Logf("Expected no match\n")
+		t.Fail()
+	}
+}
+
+// Insert shorter keys that land on existing non-leaf nodes
+func TestInsertMidPath(t *testing.T) {
+	r := New32()
+	addRoute(t, r, "10.1.0.0/16", 1)
+	addRoute(t, r, "10.2.0.0/16", 2)
+	addRoute(t, r, "10.1.0.0/24", 3)
+	addRoute(t, r, "10.1.1.0/24", 4)
+	nodes := func() (i int) {
+		r.Do(func(*Radix32, int, int) { i++ })
+		return
+	}
+	before := nodes()
+	addRoute(t, r, "10.0.0.0/8", 5)
+	addRoute(t, r, "10.0.0.0/12", 6)
+	if n := nodes(); n != before {
+		t.Logf("Expected the keys to use existing nodes, got %d nodes instead of %d\n", n, before)
+		t.Fail()
+	}
+	for bits, v := range map[int]uint32{8: 5, 12: 6} {
+		x := r.Find(0x0A000000, bits)
+		if x == nil || x.Value != v || x.Bits() != bits || x.Leaf() || x.depth() != bits {
+			t.Logf("Expected /%d with value %d on a non-leaf node at depth %d\n", bits, v, bits)
+			t.Fail()
+		}
+	}
+	testips := map[string]uint32{
+		"10.1.0.1/32":   3,
+		"10.1.1.1/32":   4,
+		"10.1.2.1/32":   1,
+		"10.2.0.1/32":   2,
+		"10.3.0.1/32":   6,
+		"10.128.0.1/32": 5,
+	}
+	for ip, asn := range testips {
+		if x := findRoute(t, r, ip); asn != x {
+			t.Logf("Expected %d, got %d for %s\n", asn, x, ip)
+			t.Fail()
+		}
+	}
+}
+
+func TestApply(t *testing.T) {
+	r := New32()
+	addRoute(t, r, "10.0.0.0/8", 1)
+	addRoute(t, r, "192.168.0.0/16", 2)
+
+	ops := []Op32{
+		{OpInsert, 0x0A010000, 16, 3},
+		{OpUpdate, 0x0A000000, 8, 4},
+		{OpRemove, 0xC0A80000, 16, 0},
+	}
+	if err := r.Apply(ops); err != nil {
+		t.Logf("Expected no error, got %v\n", err)
+		t.FailNow()
+	}
+	want := r.ToProtoEntries()
+	if len(want) != 2 || want[0].Value != 4 || want[1].Value != 3 {
+		t.Logf("Unexpected tree after Apply: %v\n", want)
+		t.Fail()
+	}
+
+	ops = []Op32{
+		{OpInsert, 0x08080800, 24, 5},
+		{OpRemove, 0x0A010000, 16, 0},
+		{OpRemove, 0x0A010000, 16, 0}, // already gone
+		{OpInsert, 0xC0A80000, 16, 6},
+	}
+	if err := r.Apply(ops); !errors.Is(err, ErrNotFound) {
+		t.Logf("Expected %v, got %v\n", ErrNotFound, err)
+		t.Fail()
+	}
+	if got := r.ToProtoEntries(); !reflect.DeepEqual(want, got) {
+		t.Logf("Expected the tree to be rolled back to %v, got %v\n", want, got)
+		t.Fail()
+	}
+	if err := r.Apply([]Op32{{OpInsert, 0, 33, 1}}); err == nil {
+		t.Logf("Expected an error for 33 bits\n")
+		t.Fail()
+	}
+
+	// The operations are applied in place, so nodes stay part of the tree
+	x := r.Find(0x0A000000, 8)
+	if err := r.Apply([]Op32{{OpInsert, 0x0B000000, 8, 7}}); err != nil {
+		t.Logf("Expected no error, got %v\n", err)
+		t.Fail()
+	}
+	x.Value = 8
+	if v := findRoute(t, r, "10.0.0.1/32"); v != 8 {
+		t.Logf("Expected a node from before Apply to stay in the tree\n")
+		t.Fail()
+	}
+	// A remove of a key inserted earlier in the batch is valid
+	ops = []Op32{
+		{OpInsert, 0x0C000000, 8, 9},
+		{OpRemove, 0x0C000000, 8, 0},
+		{OpUpdate, 0x0C000000, 8, 1},
+	}
+	if err := r.Apply(ops); !errors.Is(err, ErrNotFound) || r.Find(0x0C000000, 8) != nil {
+		t.Logf("Expected %v for the update and no 12.0.0.0/8, got %v\n", ErrNotFound, err)
+		t.Fail()
+	}
+
+	// In an aggregating tree a failing batch is rolled back too
+	a := NewAutoAggregate32()
+	addRoute(t, a, "10.0.0.0/9", 1)
+	want = a.ToProtoEntries()
+	ops = []Op32{
+		{OpInsert, 0x0A800000, 9, 1},
+		{OpRemove, 0x0A800000, 9, 0}, // merged into 10.0.0.0/8
+	}
+	if err := a.Apply(ops); !errors.Is(err, ErrNotFound) {
+		t.Logf("Expected %v, got %v\n", ErrNotFound, err)
+		t.Fail()
+	}
+	if got := a.ToProtoEntries(); !reflect.DeepEqual(want, got) {
+		t.Logf("Expected the tree to be rolled back to %v, got %v\n", want, got)
+		t.Fail()
+	}
+}
+
+func TestBranch(t *testing.T) {
+	r := newTree32()
+	r.Do(func(r1 *Radix32, l, i int) {
+		if r1.Branch(0) != r1.branch[0] || r1.Branch(1) != r1.branch[1] || r1.Branch(2) != nil {
+			t.Logf("Branch does not match the branches of %032b/%d\n", r1.key, r1.bits)
+			t.Fail()
+		}
+	})
+	// Walk down to 0x90000000 by hand
+	n := uint32(0x90000000)
+	x := r
+	for d := 0; !x.Leaf(); d++ {
+		x = x.Branch(BitK32(n, bitSize32-1-d))
+	}
+	if x.Key() != n || x.Value != 2013 {
+		t.Logf("Expected %032b, got %032b\n", n, x.Key())
+		t.Fail()
+	}
+}
+
+func TestAddressCountForValue(t *testing.T) {
+	r := New32()
+	addRoute(t, r, "10.0.0.0/16", 1)
+	addRoute(t, r, "10.0.1.0/24", 1) // nested, not counted twice
+	addRoute(t, r, "10.0.2.0/24", 2)
+	addRoute(t, r, "192.168.0.0/24", 1)
+
+	if c := r.AddressCountForValue(1); c != 65536+256 {
+		t.Logf("Expected %d, got %d\n", 65536+256, c)
+		t.Fail()
+	}
+	if c := r.AddressCountForValue(2); c != 256 {
+		t.Logf("Expected %d, got %d\n", 256, c)
+		t.Fail()
+	}
+	if c := r.AddressCountForValue(3); c != 0 {
+		t.Logf("Expected %d, got %d\n", 0, c)
+		t.Fail()
+	}
+}
+
+func TestValueIndexed(t *testing.T) {
+	r := NewValueIndexed32()
+	check := func() {
+		g := r.Tree().GroupByValue()
+		for v, want := range g {
+			if got := r.PrefixesForValue(v); !reflect.DeepEqual(want, got) {
+				t.Logf("Expected %v, got %v for value %d\n", want, got, v)
+				t.Fail()
+			}
+		}
+		if len(g) != len(r.index) {
+			t.Logf("Expected %d values in the index, got %d\n", len(g), len(r.index))
+			t.Fail()
+		}
+	}
+	r.Insert(0x0A000000, 8, 1)
+	r.Insert(0x0A010000, 16, 2)
+	r.Insert(0x0A020000, 16, 1)
+	r.Insert(0xC0A80000, 16, 2)
+	r.Insert(0xC0A80100, 24, 3)
+	check()
+	r.Insert(0x0A010000, 16, 3) // overwrite
+	r.Remove(0x0A000000, 8)
+	r.Remove(0x0B000000, 8) // absent
+	check()
+	if p := r.PrefixesForValue(3); len(p) != 2 || p[0].Key() != 0x0A010000 {
+		t.Logf("Expected 2 keys with value 3, got %d\n", len(p))
+		t.Fail()
+	}
+	if p := r.PrefixesForValue(4); len(p) != 0 {
+		t.Logf("Expected no keys with value 4, got %d\n", len(p))
+		t.Fail()
+	}
+	// A panicking insert leaves the index alone
+	func() {
+		defer func() { recover() }()
+		r.Insert(0x0A010000, 40, 4)
+	}()
+	check()
+}
+
+func TestMaxPrefixLen(t *testing.T) {
+	r := New32()
+	if m := r.MaxPrefixLen(); m != 0 {
+		t.Logf("Expected %d, got %d\n", 0, m)
+		t.Fail()
+	}
+	addRoute(t, r, "10.0.0.0/8", 1)
+	addRoute(t, r, "10.1.2.16/28", 2)
+	addRoute(t, r, "10.1.0.0/16", 3)
+	addRoute(t, r, "192.168.1.0/24", 4)
+	if m := r.MaxPrefixLen(); m != 28 {
+		t.Logf("Expected %d, got %d\n", 28, m)
+		t.Fail()
+	}
+}
+
+func TestFindReversed(t *testing.T) {
+	reverse := func(n uint32) (m uint32) {
+		for i := 0; i < 32; i++ {
+			m = m<<1 | n>>uint(i)&1
+		}
+		return
+	}
+	r := New32()
+	ids := map[uint32]uint32{0x00000001: 1, 0x12345678: 2, 0xF0000000: 3}
+	for id, v := range ids {
+		r.Insert(reverse(id), 32, v)
+	}
+	// All IDs ending in 0xFF, stored reversed as an 8 bit prefix
+	r.Insert(reverse(0xFF), 8, 4)
+
+	for id, v := range ids {
+		if x, bits := r.FindReversed(id); x == nil || x.Value != v || bits != 32 {
+			t.Logf("Expected %d for %08x\n", v, id)
+			t.Fail()
+		}
+	}
+	if x, bits := r.FindReversed(0xABCDEFFF); x == nil || x.Value != 4 || bits != 8 {
+		t.Logf("Expected %d for %08x\n", 4, 0xABCDEFFF)
+		t.Fail()
+	}
+	if x, bits := r.FindReversed(0x00000002); x != nil || bits != 0 {
+		t.Logf("Expected no match for %08x\n", 2)
+		t.Fail()
+	}
+}
+
+func TestSkew(t *testing.T) {
+	skewed, balanced := New32(), New32()
+	for i := uint32(0); i < 100; i++ {
+		skewed.Insert(i<<8, 24, i)             // all in 0.0.0.0/1
+		balanced.Insert(i<<8|(i%2)<<31, 24, i) // alternating halves
+	}
+	if s := skewed.Skew(); s < 0.9 {
+		t.Logf("Expected a skew near 1, got %f\n", s)
+		t.Fail()
+	}
+	if s := balanced.Skew(); s > 0.1 {
+		t.Logf("Expected a skew near 0, got %f\n", s)
+		t.Fail()
+	}
+	if s := New32().Skew(); s != 0 {
+		t.Logf("Expected 0 for an empty tree, got %f\n", s)
+		t.Fail()
+	}
+}
+
+func TestPrefixesInRange(t *testing.T) {
+	r := New32()
+	addRoute(t, r, "9.0.0.0/8", 1)
+	addRoute(t, r, "10.0.0.0/8", 2)
+	addRoute(t, r, "10.1.0.0/16", 3)
+	addRoute(t, r, "10.255.0.0/16", 4)
+	addRoute(t, r, "11.0.0.0/8", 5)
+	addRoute(t, r, "11.0.0.0/16", 6)
+	addRoute(t, r, "11.128.0.0/16", 7)
+	addRoute(t, r, "12.0.0.0/8", 8)
+
+	// 10.200.0.0 - 11.5.0.0 spans parts of 10.0.0.0/8 and 11.0.0.0/8
+	got := make([]uint32, 0)
+	for _, x := range r.PrefixesInRange(0x0AC80000, 0x0B050000) {
+		got = append(got, x.Value)
+	}
+	if want := []uint32{2, 4, 5, 6}; !reflect.DeepEqual(want, got) {
+		t.Logf("Expected %v, got %v\n", want, got)
+		t.Fail()
+	}
+	if x := r.PrefixesInRange(0x0B050000, 0x0AC80000); len(x) != 0 {
+		t.Logf("Expected nothing for an empty range, got %d\n", len(x))
+		t.Fail()
+	}
+}
+
+func TestTree(t *testing.T) {
+	r := newTree32()
+	r.Insert(0, 1, 2000)
+	want := `.
+├─0        00000000000000000000000000000000/1 -> 2000
+│ └─1      01000000000000000000000000000000/5 -> 2010
+└─1
+  └─0
+    └─0
+      ├─0  10000000000000000000000000000000/5 -> 2012
+      └─1  10010000000000000000000000000000/5 -> 2013
+`
+	if s := r.Tree(); s != want {
+		t.Logf("Expected\n%s\ngot\n%s\n", want, s)
+		t.Fail()
+	}
+}
+
+func TestEqualKeys(t *testing.T) {
+	r1, r2 := New32(), New32()
+	addRoute(t, r1, "10.0.0.0/8", 1)
+	addRoute(t, r1, "10.1.0.0/16", 2)
+	addRoute(t, r1, "0.0.0.0/0", 3)
+	// different insert order and values
+	addRoute(t, r2, "0.0.0.0/0", 6)
+	addRoute(t, r2, "10.1.0.0/16", 5)
+	addRoute(t, r2, "10.0.0.0/8", 4)
+
+	if !r1.EqualKeys(r2) {
+		t.Logf("Expected the same keys\n")
+		t.Fail()
+	}
+	if r1.Equal(r2) {
+		t.Logf("Expected the trees to differ in their values\n")
+		t.Fail()
+	}
+	addRoute(t, r2, "10.1.0.0/24", 7)
+	if r1.EqualKeys(r2) || r2.EqualKeys(r1) {
+		t.Logf("Expected different keys\n")
+		t.Fail()
+	}
+	if !r1.Equal(r1.copy(nil)) {
+		t.Logf("Expected a copy to be equal\n")
+		t.Fail()
+	}
+}
+
+func TestFindByValue(t *testing.T) {
+	r := New32()
+	addRoute(t, r, "192.168.0.0/16", 300)
+	addRoute(t, r, "10.0.0.0/8", 100)
+	addRoute(t, r, "10.1.0.0/16", 250)
+	addRoute(t, r, "172.16.0.0/12", 400)
+
+	visited := 0
+	x, ok := r.FindByValue(func(v uint32) bool {
+		visited++
+		return v > 200
+	})
+	if !ok || x.Value != 250 || x.Key() != 0x0A010000 {
+		t.Logf("Expected 10.1.0.0/16 with value %d\n", 250)
+		t.Fail()
+	}
+	if visited != 2 {
+		t.Logf("Expected the search to stop after %d keys, got %d\n", 2, visited)
+		t.Fail()
+	}
+	if _, ok := r.FindByValue(func(v uint32) bool { return v > 1000 }); ok {
+		t.Logf("Expected no match\n")
+		t.Fail()
+	}
+}
+
+// Run with -race: lookups continue on the live tree while a minimized
+// tree is built and swapped in.
+func TestMinimizeSwap(t *testing.T) {
+	r := New32()
+	for i := uint32(0); i < 1024; i++ {
+		r.Insert(0x0A000000|i<<8, 24, i%4)
+	}
+	var live atomic.Value
+	live.Store(r)
+
+	var wg sync.WaitGroup
+	done := make(chan bool)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := uint32(0); ; n++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				k := 0x0A000000 | n%1024<<8
+				if x := live.Load().(*Radix32).Find(k, 32); x == nil || x.Value != n%1024%4 {
+					t.Logf("Expected %d for %s\n", n%1024%4, ip32(k))
+					t.Fail()
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		live.Store(live.Load().(*Radix32).Minimize())
+	}
+	close(done)
+	wg.Wait()
+	if n := live.Load().(*Radix32).Len(); n >= r.Len() {
+		t.Logf("Expected the live tree to be minimized, got %d keys\n", n)
+		t.Fail()
+	}
+}
+
+func TestShardKey(t *testing.T) {
+	r := New32()
+	for i := uint32(0); i < 1000; i++ {
+		r.Insert(0x0A000000|i<<8, 24, i)
+	}
+	s1, s2 := r.ShardKey(4), r.ShardKey(4)
+	if !reflect.DeepEqual(s1, s2) {
+		t.Logf("Expected the same shards on every call\n")
+		t.Fail()
+	}
+	total := 0
+	for i, s := range s1 {
+		if i < 0 || i >= 4 || len(s) < 150 || len(s) > 350 {
+			t.Logf("Unexpected shard %d with %d keys\n", i, len(s))
+			t.Fail()
+		}
+		total += len(s)
+	}
+	if total != 1000 {
+		t.Logf("Expected %d keys in the shards, got %d\n", 1000, total)
+		t.Fail()
+	}
+	// a copy of the tree shards the same
+	c := r.copy(nil).ShardKey(4)
+	for i := range s1 {
+		if len(c[i]) != len(s1[i]) || c[i][0].key != s1[i][0].key {
+			t.Logf("Expected shard %d to be the same for a copy\n", i)
+			t.Fail()
+		}
+	}
+}
+
+func TestGetOrInsert(t *testing.T) {
+	r := New32()
+	addRoute(t, r, "10.0.0.0/8", 1)
+	if x, ok := r.GetOrInsert(0x0A000000, 8, 2); ok || x.Value != 1 {
+		t.Logf("Expected the existing value %d to be kept\n", 1)
+		t.Fail()
+	}
+	if x, ok := r.GetOrInsert(0x0A010000, 16, 3); !ok || x.Value != 3 {
+		t.Logf("Expected 10.1.0.0/16 to be inserted\n")
+		t.Fail()
+	}
+	if x := r.Find(0x0A000001, 32); x.Value != 1 {
+		t.Logf("Expected %d, got %d\n", 1, x.Value)
+		t.Fail()
+	}
+
+	// A canonical tree rejects host bits, also when the masked key is stored
+	c := NewCanonical32()
+	addRoute(t, c, "10.0.0.0/8", 1)
+	if x, ok := c.GetOrInsert(0x0A000001, 8, 2); x != nil || ok {
+		t.Logf("Expected 10.0.0.1/8 to be rejected\n")
+		t.Fail()
+	}
+	if x, ok := c.GetOrInsert(0x0B000001, 8, 2); x != nil || ok || c.Len() != 1 {
+		t.Logf("Expected 11.0.0.1/8 to be rejected\n")
+		t.Fail()
+	}
+	if x, ok := c.GetOrInsert(0x0B000000, 8, 2); x == nil || !ok {
+		t.Logf("Expected 11.0.0.0/8 to be inserted\n")
+		t.Fail()
+	}
+}
+
+// There is no locking wrapper for a tree, so callers guard it themselves; with
+// a mutex GetOrInsert inserts every key exactly once. Run with -race.
+func TestGetOrInsertWithMutex(t *testing.T) {
+	var mu sync.Mutex
+	r := New32()
+	inserted := make([]int, 64)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := uint32(0); i < 64; i++ {
+				mu.Lock()
+				if _, ok := r.GetOrInsert(0x0A000000|i<<8, 24, uint32(g)); ok {
+					inserted[i]++
+				}
+				mu.Unlock()
+			}
+		}(g)
+	}
+	wg.Wait()
+	for i, n := range inserted {
+		if n != 1 {
+			t.Logf("Expected key %d to be inserted once, got %d\n", i, n)
+			t.Fail()
+		}
+	}
+	if n := r.Len(); n != 64 {
+		t.Logf("Expected %d keys, got %d\n", 64, n)
+		t.Fail()
+	}
+}
+
+func TestAllocateAligned(t *testing.T) {
+	r := New32()
+	addRoute(t, r, "10.0.0.0/24", 1)
+	addRoute(t, r, "10.0.0.64/27", 2)
+	seen := make([]uint32, 0)
+	for i := 0; i < 3; i++ {
+		n, ok := r.AllocateAligned(26, 0x0A000000, 24)
+		if !ok {
+			t.Logf("Expected a free /26 in allocation %d\n", i)
+			t.Fail()
+			continue
+		}
+		if n&^bitMask32(26) != 0 {
+			t.Logf("Expected %s to be aligned on a /26\n", ip32(n))
+			t.Fail()
+		}
+		for _, s := range seen {
+			if s == n {
+				t.Logf("Expected %s to be allocated once\n", ip32(n))
+				t.Fail()
+			}
+		}
+		seen = append(seen, n)
+	}
+	// 10.0.0.64/26 holds the /27, so it is skipped
+	if !reflect.DeepEqual(seen, []uint32{0x0A000000, 0x0A000080, 0x0A0000C0}) {
+		t.Logf("Expected 10.0.0.0, .128 and .192, got %v\n", seen)
+		t.Fail()
+	}
+	if _, ok := r.AllocateAligned(26, 0x0A000000, 24); ok {
+		t.Logf("Expected no free /26 left\n")
+		t.Fail()
+	}
+
+	// Reservations would be merged in an aggregating tree
+	a := NewAutoAggregate32()
+	for i := 0; i < 6; i++ {
+		if n, ok := a.AllocateAligned(26, 0x0A000000, 24); ok {
+			t.Logf("Expected no allocation in an aggregating tree, got %s\n", ip32(n))
+			t.Fail()
+		}
+	}
+	if n := a.Len(); n != 0 {
+		t.Logf("Expected no keys, got %d\n", n)
+		t.Fail()
+	}
+}
+
+// Inserting a new key and removing it again must restore the tree as it was,
+// intermediate nodes created for the key included.
+func TestRemoveRestoresStructure(t *testing.T) {
+	rnd := rand.New(rand.NewSource(42))
+	r := New32()
+	for i := 0; i < 2000; i++ {
+		n, bits := rnd.Uint32(), rnd.Intn(33)
+		n &= bitMask32(bits)
+		if r.exact(n, bits) != nil {
+			continue
+		}
+		snap := r.copy(nil)
+		r.Insert(n, bits, uint32(i))
+		if i%2 == 0 { // keep some keys to grow the tree
+			continue
+		}
+		if r.Remove(n, bits) == nil {
+			t.Logf("Expected %s/%d to be removed\n", ip32(n), bits)
+			t.Fail()
+		}
+		if !r.StructEqual(snap) {
+			t.Logf("Expected the tree to be restored after removing %s/%d\n", ip32(n), bits)
+			t.Fail()
+			return
+		}
+	}
+}
+
+func TestSExpr(t *testing.T) {
+	r := New32()
+	if s := r.SExpr(); s != "()" {
+		t.Logf("Expected %q for an empty tree, got %q\n", "()", s)
+		t.Fail()
+	}
+	addRoute(t, r, "0.0.0.0/1", 1)
+	addRoute(t, r, "128.0.0.0/2", 2)
+	addRoute(t, r, "192.0.0.0/2", 3)
+	expected := "(node 31 (0 (leaf 0 1 1)) (1 (node 30 (0 (leaf 2147483648 2 2)) (1 (leaf 3221225472 2 3)))))"
+	s := r.SExpr()
+	if s != expected {
+		t.Logf("Expected %s, got %s\n", expected, s)
+		t.Fail()
+	}
+	depth := 0
+	for _, c := range s {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		}
+		if depth < 0 {
+			break
+		}
+	}
+	if depth != 0 {
+		t.Logf("Expected balanced parentheses in %s\n", s)
+		t.Fail()
+	}
+}
+
+func TestHostOrder(t *testing.T) {
+	r := New32()
+	ip := net.ParseIP("10.1.0.0").To4()
+	r.InsertHostOrder(binary.NativeEndian.Uint32(ip), 16, 7)
+	if x := r.Find(binary.BigEndian.Uint32(net.ParseIP("10.1.2.3").To4()), 32); x == nil || x.Value != 7 {
+		t.Logf("Expected 10.1.0.0/16 to be found in network order\n")
+		t.Fail()
+	}
+	if x := r.FindHostOrder(binary.NativeEndian.Uint32(net.ParseIP("10.1.2.3").To4()), 32); x == nil || x.Value != 7 {
+		t.Logf("Expected 10.1.0.0/16 to be found in host order\n")
+		t.Fail()
+	}
+	if x := r.FindHostOrder(binary.NativeEndian.Uint32(net.ParseIP("10.2.0.1").To4()), 32); x != nil {
+		t.Logf("Expected 10.2.0.1 not to be found, got %s/%d\n", ip32(x.Key()), x.Bits())
+		t.Fail()
+	}
+}
+
+func TestDisjointCover(t *testing.T) {
+	r := New32()
+	addRoute(t, r, "10.0.0.0/8", 1)
+	addRoute(t, r, "10.1.0.0/16", 2)
+	if e := r.DisjointCover(); !reflect.DeepEqual(e, []Entry32{{0x0A000000, 8, 1}}) {
+		t.Logf("Expected only 10.0.0.0/8, got %v\n", e)
+		t.Fail()
+	}
+	addRoute(t, r, "11.0.0.0/8", 3)
+	addRoute(t, r, "12.0.0.0/9", 4)
+	addRoute(t, r, "12.128.0.0/9", 5)
+	addRoute(t, r, "12.128.0.0/16", 6)
+	expected := []Entry32{{0x0A000000, 7, 1}, {0x0C000000, 8, 4}}
+	if e := r.DisjointCover(); !reflect.DeepEqual(e, expected) {
+		t.Logf("Expected %v, got %v\n", expected, e)
+		t.Fail()
+	}
+}
+
+func TestFindOrError(t *testing.T) {
+	r := New32()
+	if _, err := r.FindOrError(0x0A010203); !errors.Is(err, ErrNotFound) || !strings.Contains(err.Error(), "no partial match") {
+		t.Logf("Expected no partial match, got %v\n", err)
+		t.Fail()
+	}
+	addRoute(t, r, "10.0.0.0/16", 1)
+	addRoute(t, r, "192.168.0.0/16", 2)
+	if x, err := r.FindOrError(0x0A000203); err != nil || x.Value != 1 {
+		t.Logf("Expected 10.0.2.3 to match 10.0.0.0/16, got %v\n", err)
+		t.Fail()
+	}
+	_, err := r.FindOrError(0x0A010203)
+	if !errors.Is(err, ErrNotFound) {
+		t.Logf("Expected %v, got %v\n", ErrNotFound, err)
+		t.Fail()
+	}
+	if err != nil && !strings.Contains(err.Error(), "10.1.2.3; deepest partial match was 10.0.0.0/16 diverging at bit 15") {
+		t.Logf("Expected the match and divergence bit in %q\n", err)
+		t.Fail()
+	}
+}
+
+func TestTopBitHistogram(t *testing.T) {
+	r := New32()
+	addRoute(t, r, "0.0.0.0/0", 1)
+	addRoute(t, r, "10.0.0.0/8", 2)
+	addRoute(t, r, "127.0.0.0/8", 3)
+	addRoute(t, r, "192.168.0.0/16", 4)
+	if h := r.TopBitHistogram(1); !reflect.DeepEqual(h, []int{3, 1}) {
+		t.Logf("Expected [3 1], got %v\n", h)
+		t.Fail()
+	}
+	if h := r.TopBitHistogram(0); !reflect.DeepEqual(h, []int{4}) {
+		t.Logf("Expected [4], got %v\n", h)
+		t.Fail()
+	}
+	for _, b := range []int{-1, 17, 32} {
+		if h := r.TopBitHistogram(b); h != nil {
+			t.Logf("Expected nil for %d bits, got %d buckets\n", b, len(h))
+			t.Fail()
+		}
+	}
+	if h := r.TopBitHistogram(16); len(h) != 1<<16 || h[0x0A00] != 1 {
+		t.Logf("Expected 10.0.0.0/8 in bucket %d\n", 0x0A00)
+		t.Fail()
+	}
+}
+
+func TestLoad(t *testing.T) {
+	r := New32()
+	addRoute(t, r, "0.0.0.0/0", 1)
+	addRoute(t, r, "10.0.0.0/8", 2)
+	addRoute(t, r, "10.1.0.0/16", 3)
+	r.Load([]Entry32{{0xC0A80000, 16, 4}, {0x0A000000, 8, 5}})
+	expected := []Entry32{{0x0A000000, 8, 5}, {0xC0A80000, 16, 4}}
+	if e := r.DisjointCover(); !reflect.DeepEqual(e, expected) || r.Len() != 2 {
+		t.Logf("Expected %v, got %v\n", expected, e)
+		t.Fail()
+	}
+	if x := r.Find(0x0B000001, 32); x != nil {
+		t.Logf("Expected the default route to be gone, got %s/%d\n", ip32(x.Key()), x.Bits())
+		t.Fail()
+	}
+	if x := r.Find(0x0A010001, 32); x == nil || x.Value != 5 {
+		t.Logf("Expected 10.1.0.1 to match 10.0.0.0/8\n")
+		t.Fail()
+	}
+}
+
+func TestOverlapsTree(t *testing.T) {
+	a, b := New32(), New32()
+	addRoute(t, a, "10.0.0.0/8", 1)
+	addRoute(t, a, "192.168.0.0/16", 2)
+	addRoute(t, b, "11.0.0.0/8", 3)
+	addRoute(t, b, "192.169.0.0/16", 4)
+	if a.OverlapsTree(b) || b.OverlapsTree(a) {
+		t.Logf("Expected disjoint trees not to overlap\n")
+		t.Fail()
+	}
+	if a.OverlapsTree(New32()) {
+		t.Logf("Expected no overlap with an empty tree\n")
+		t.Fail()
+	}
+	addRoute(t, b, "10.20.30.0/24", 5)
+	if !a.OverlapsTree(b) || !b.OverlapsTree(a) {
+		t.Logf("Expected 10.0.0.0/8 and 10.20.30.0/24 to overlap\n")
+		t.Fail()
+	}
+	c := New32()
+	addRoute(t, c, "0.0.0.0/0", 6)
+	if !c.OverlapsTree(b) || !b.OverlapsTree(c) {
+		t.Logf("Expected the default route to overlap\n")
+		t.Fail()
+	}
+	// random trees against the pairwise answer
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		x, y := New32(), New32()
+		for j := 0; j < 4; j++ {
+			x.Insert(rnd.Uint32(), 1+rnd.Intn(8), 0)
+			y.Insert(rnd.Uint32(), 1+rnd.Intn(8), 0)
+		}
+		expected := false
+		x.walk(func(x1 *Radix32) bool {
+			y.walk(func(y1 *Radix32) bool {
+				m := bitMask32(min(int(x1.bits), int(y1.bits)))
+				expected = expected || x1.key&m == y1.key&m
+				return true
+			})
+			return true
+		})
+		if x.OverlapsTree(y) != expected {
+			t.Logf("Expected %v for\n%s\nand\n%s\n", expected, x.Tree(), y.Tree())
+			t.Fail()
+			return
+		}
+	}
+}
+
+func TestMinus(t *testing.T) {
+	a, b := New32(), New32()
+	addRoute(t, a, "0.0.0.0/0", 1)
+	addRoute(t, a, "10.0.0.0/8", 2)
+	addRoute(t, a, "10.1.0.0/16", 3)
+	addRoute(t, a, "192.168.0.0/16", 4)
+	addRoute(t, b, "10.0.0.0/8", 5)
+	addRoute(t, b, "192.168.0.0/24", 6)
+	expected := New32()
+	addRoute(t, expected, "0.0.0.0/0", 1)
+	addRoute(t, expected, "10.1.0.0/16", 3)
+	addRoute(t, expected, "192.168.0.0/16", 4)
+	if m := a.Minus(b); !m.Equal(expected) {
+		t.Logf("Expected\n%s\ngot\n%s\n", expected.Tree(), m.Tree())
+		t.Fail()
+	}
+	if m := a.Minus(a); m.Len() != 0 {
+		t.Logf("Expected an empty tree, got %d keys\n", m.Len())
+		t.Fail()
+	}
+}
+
+// Trees built from a tree keep its mode and width.
+func TestDerivedTreeMode(t *testing.T) {
+	r := NewCanonical32()
+	r.flags |= flagAggregate
+	r.width = 24
+	addRoute(t, r, "10.0.0.0/8", 1)
+	addRoute(t, r, "10.1.0.0/16", 2)
+	addRoute(t, r, "192.168.0.0/24", 3)
+	trees := map[string]*Radix32{"Minus": r.Minus(New32()), "Minimize": r.Minimize(), "Canonicalize": r.Canonicalize()}
+	for i, p := range r.Partition(4) {
+		trees[fmt.Sprintf("Partition %d", i)] = p
+	}
+	for name, x := range trees {
+		if x.flags&^flagDefault != flagCanonical|flagAggregate || x.Width() != 24 {
+			t.Logf("Expected %s to keep the mode and width, got flags %d and width %d\n", name, x.flags, x.Width())
+			t.Fail()
+		}
+	}
+	if m := r.Minus(New32()); !m.StructEqual(r) {
+		t.Logf("Expected Minus to keep the keys as they are\n")
+		t.Fail()
+	}
+}
+
+func TestLookupRange(t *testing.T) {
+	r := New32()
+	addRoute(t, r, "10.1.2.0/24", 7)
+	n := uint32(0x0A010203)
+	start, end, v, ok := r.LookupRange(n)
+	if !ok || start != n&bitMask32(24) || end != start|^bitMask32(24) || v != 7 {
+		t.Logf("Expected 10.1.2.0 - 10.1.2.255 -> 7, got %s - %s -> %d\n", ip32(start), ip32(end), v)
+		t.Fail()
+	}
+	if _, _, _, ok := r.LookupRange(0x0A010303); ok {
+		t.Logf("Expected no match for 10.1.3.3\n")
+		t.Fail()
+	}
+	addRoute(t, r, "0.0.0.0/0", 1)
+	if start, end, v, ok := r.LookupRange(0x0A010303); !ok || start != 0 || end != mask32 || v != 1 {
+		t.Logf("Expected the whole address space -> 1, got %s - %s -> %d\n", ip32(start), ip32(end), v)
+		t.Fail()
+	}
+}
+
+func TestDoLimited(t *testing.T) {
+	r := New32()
+	addRoute(t, r, "10.0.0.0/8", 1)
+	addRoute(t, r, "10.1.0.0/16", 2)
+	addRoute(t, r, "192.168.0.0/16", 3)
+	visited := 0
+	r.DoLimited(4, func(x *Radix32, depth int) bool {
+		if depth > 4 {
+			t.Logf("Expected no nodes below depth %d, got one at %d\n", 4, depth)
+			t.Fail()
+		}
+		if x.depth() != depth {
+			t.Logf("Expected depth %d, got %d\n", x.depth(), depth)
+			t.Fail()
+		}
+		visited++
+		return true
+	})
+	if visited == 0 {
+		t.Logf("Expected nodes to be visited\n")
+		t.Fail()
+	}
+	visited = 0
+	r.DoLimited(bitSize32, func(x *Radix32, depth int) bool {
+		visited++
+		return visited < 3
+	})
+	if visited != 3 {
+		t.Logf("Expected the walk to stop after %d nodes, got %d\n", 3, visited)
+		t.Fail()
+	}
+	visited = 0
+	r.DoLimited(0, func(x *Radix32, depth int) bool {
+		visited++
+		return true
+	})
+	if visited != 1 {
+		t.Logf("Expected only the root to be visited, got %d nodes\n", visited)
+		t.Fail()
+	}
+}
+
+func TestCoverageByLength(t *testing.T) {
+	r := New32()
+	addRoute(t, r, "10.0.0.0/8", 1)
+	addRoute(t, r, "10.1.0.0/16", 2)
+	addRoute(t, r, "192.168.0.0/16", 3)
+	expected := map[int]uint64{8: 1 << 24, 16: 2 << 16}
+	if c := r.CoverageByLength(); !reflect.DeepEqual(c, expected) {
+		t.Logf("Expected %v, got %v\n", expected, c)
+		t.Fail()
+	}
+	addRoute(t, r, "0.0.0.0/0", 4)
+	if c := r.CoverageByLength(); c[0] != 1<<32 {
+		t.Logf("Expected %d keys for the default route, got %d\n", uint64(1<<32), c[0])
+		t.Fail()
+	}
+}
+
+func TestUpsert(t *testing.T) {
+	r := New32()
+	addRoute(t, r, "10.0.0.0/8", 5)
+	max := func(v uint32) func(uint32, bool) uint32 {
+		return func(old uint32, existed bool) uint32 {
+			if existed && old > v {
+				return old
+			}
+			return v
+		}
+	}
+	if x := r.Upsert(0x0A000000, 8, max(3)); x.Value != 5 {
+		t.Logf("Expected %d to be kept, got %d\n", 5, x.Value)
+		t.Fail()
+	}
+	if x := r.Upsert(0x0A000000, 8, max(9)); x.Value != 9 {
+		t.Logf("Expected %d, got %d\n", 9, x.Value)
+		t.Fail()
+	}
+	existed := true
+	x := r.Upsert(0x0A010000, 16, func(old uint32, e bool) uint32 {
+		existed = e
+		return 2
+	})
+	if existed || x.Value != 2 || r.Len() != 2 {
+		t.Logf("Expected 10.1.0.0/16 to be inserted with value %d\n", 2)
+		t.Fail()
+	}
+
+	// Against Insert, for keys on all kinds of nodes
+	rnd := rand.New(rand.NewSource(5))
+	a, b := New32(), New32()
+	for i := 0; i < 2000; i++ {
+		n, bits := rnd.Uint32(), rnd.Intn(33)
+		if i%3 == 0 {
+			n, bits = 0x0A000000, rnd.Intn(9) // hit keys on non-leaf nodes
+		}
+		var old uint32
+		if x := a.exact(n&bitMask32(bits), bits); x != nil {
+			old = x.Value
+		}
+		a.Insert(n, bits, old+uint32(i))
+		b.Upsert(n, bits, func(o uint32, _ bool) uint32 { return o + uint32(i) })
+	}
+	if !a.StructEqual(b) {
+		t.Logf("Expected Upsert to build the same tree as Insert\n")
+		t.Fail()
+	}
+
+	c := NewCanonical32()
+	called := false
+	if x := c.Upsert(0x0A000001, 8, func(uint32, bool) uint32 { called = true; return 1 }); x != nil || called {
+		t.Logf("Expected f not to be called for a rejected key\n")
+		t.Fail()
+	}
+}
+
+func TestNewWithBits32(t *testing.T) {
+	r := NewWithBits32(16)
+	if w := r.Width(); w != 16 {
+		t.Logf("Expected width %d, got %d\n", 16, w)
+		t.Fail()
+	}
+	if x := r.Insert(0x0A010000, 16, 1); x == nil {
+		t.Logf("Expected a /16 to be accepted\n")
+		t.Fail()
+	}
+	if _, err := r.TryInsert(0x0A010000, 20, 2); err != ErrPrefixLen {
+		t.Logf("Expected %v, got %v\n", ErrPrefixLen, err)
+		t.Fail()
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Logf("Expected Insert of a /20 to panic\n")
+				t.Fail()
+			}
+		}()
+		r.Insert(0x0A010000, 20, 2)
+	}()
+	if n := r.Len(); n != 1 {
+		t.Logf("Expected %d key, got %d\n", 1, n)
+		t.Fail()
+	}
+	if _, err := New32().TryInsert(0, 33, 1); err != ErrPrefixLen {
+		t.Logf("Expected %v for a /33, got %v\n", ErrPrefixLen, err)
+		t.Fail()
+	}
+}
+
+func TestAggregationCandidates(t *testing.T) {
+	r := New32()
+	addRoute(t, r, "10.0.0.0/9", 1)
+	addRoute(t, r, "10.128.0.0/9", 1)
+	addRoute(t, r, "192.168.0.0/24", 2)
+	addRoute(t, r, "192.168.1.0/24", 2)
+	addRoute(t, r, "172.16.0.0/16", 3)
+	addRoute(t, r, "172.17.0.0/16", 4)
+	addRoute(t, r, "172.18.0.0/16", 3)
+	got := make([]string, 0)
+	for p := range r.AggregationCandidates() {
+		got = append(got, fmt.Sprintf("%s/%d+%s/%d", ip32(p[0].Key()), p[0].Bits(), ip32(p[1].Key()), p[1].Bits()))
+	}
+	expected := []string{"10.0.0.0/9+10.128.0.0/9", "192.168.0.0/24+192.168.1.0/24"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Logf("Expected %v, got %v\n", expected, got)
+		t.Fail()
+	}
+	n := 0
+	for range r.AggregationCandidates() {
+		n++
+		break
+	}
+	if n != 1 {
+		t.Logf("Expected the iteration to stop\n")
+		t.Fail()
+	}
+}
+
+func TestCanonicalize(t *testing.T) {
+	a, b := New32(), New32()
+	addRoute(t, a, "10.0.0.0/8", 1)
+	addRoute(t, a, "10.1.0.0/16", 2)
+	addRoute(t, a, "192.168.0.0/16", 3)
+	// the same table, with the /8 split and a redundant key, in another order
+	addRoute(t, b, "192.168.0.0/17", 3)
+	addRoute(t, b, "10.1.0.0/16", 2)
+	addRoute(t, b, "10.128.0.0/9", 1)
+	addRoute(t, b, "192.168.128.0/17", 3)
+	addRoute(t, b, "10.0.0.0/9", 1)
+	addRoute(t, b, "10.2.0.0/16", 1)
+	if a.StructEqual(b) {
+		t.Logf("Expected the trees to differ before canonicalization\n")
+		t.Fail()
+	}
+	if !a.Canonicalize().StructEqual(b.Canonicalize()) {
+		t.Logf("Expected equal canonical forms\n%s\nand\n%s\n", a.Canonicalize().Tree(), b.Canonicalize().Tree())
+		t.Fail()
+	}
+
+	// random tables against the same tables with their keys split in halves
+	rnd := rand.New(rand.NewSource(3))
+	for i := 0; i < 100; i++ {
+		a, b := New32(), New32()
+		for j := 0; j < 20; j++ {
+			a.Insert(rnd.Uint32(), rnd.Intn(12), uint32(rnd.Intn(3)))
+		}
+		keys := make([]Entry32, 0)
+		a.walk(func(r1 *Radix32) bool {
+			keys = append(keys, Entry32{r1.key, int(r1.bits), r1.Value})
+			return true
+		})
+		for j := len(keys) - 1; j >= 0; j-- {
+			e := keys[j]
+			b.Insert(e.Key, e.Bits, e.Value)
+			for _, h := range []uint32{e.Key, e.Key | 1<<uint(bitSize32-1-e.Bits)} {
+				if a.exact(h, e.Bits+1) == nil {
+					b.Insert(h, e.Bits+1, e.Value)
+				}
+			}
+		}
+		if !a.Canonicalize().StructEqual(b.Canonicalize()) {
+			t.Logf("Expected equal canonical forms for\n%s\nand\n%s\n", a.Tree(), b.Tree())
+			t.Fail()
+			return
+		}
+	}
+}
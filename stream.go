@@ -0,0 +1,143 @@
+package bitradix
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// The streaming format holds one entry per line, as an IPv4 prefix in CIDR
+// notation followed by the value, separated by white space:
+//
+//	10.0.0.0/8 3356
+//
+// Empty lines and lines starting with a # are ignored. The entries must be sorted
+// on the key and then on the number of bits, the order in which Keys returns them.
+
+// Formatter formats a single entry for StreamSorted.
+type Formatter func(key uint32, bits int, value uint32) []byte
+
+// FormatEntry formats an entry in the streaming format read by DiffStreams.
+func FormatEntry(key uint32, bits int, value uint32) []byte {
+	return []byte(fmt.Sprintf("%s/%d %d\n", ip32(key), bits, value))
+}
+
+// StreamSorted writes the keys in the tree r in order to w, each entry is
+// formatted with format. No intermediate copy of the keys is made.
+func (r *Radix32) StreamSorted(w io.Writer, format Formatter) error {
+	var err error
+	r.walk(func(r1 *Radix32) bool {
+		_, err = w.Write(format(r1.key, int(r1.bits), r1.Value))
+		return err == nil
+	})
+	return err
+}
+
+// ChangeKind tells what happened with an entry, see Change32.
+type ChangeKind int
+
+const (
+	Added   ChangeKind = iota // the entry is new
+	Removed                   // the entry is gone
+	Changed                   // the entry has a new value
+)
+
+// Change32 describes a difference between two streams of entries.
+type Change32 struct {
+	Kind ChangeKind
+	Key  uint32
+	Bits int
+	Old  uint32 // the old value, for Removed and Changed
+	New  uint32 // the new value, for Added and Changed
+}
+
+// entryReader32 reads the entries from a stream one by one.
+type entryReader32 struct {
+	s    *bufio.Scanner
+	line int
+	ok   bool // an entry has been read
+	key  uint32
+	bits int
+	v    uint32
+}
+
+// DiffStreams compares the sorted streams of entries a and b, without
+// building trees for them, and returns the changes needed to go from a to b.
+func DiffStreams(a, b io.Reader) ([]Change32, error) {
+	ra, rb := &entryReader32{s: bufio.NewScanner(a)}, &entryReader32{s: bufio.NewScanner(b)}
+	if err := ra.next(); err != nil {
+		return nil, err
+	}
+	if err := rb.next(); err != nil {
+		return nil, err
+	}
+	c := make([]Change32, 0)
+	for ra.ok || rb.ok {
+		switch {
+		case !rb.ok || (ra.ok && ra.less(rb)):
+			c = append(c, Change32{Removed, ra.key, ra.bits, ra.v, 0})
+			if err := ra.next(); err != nil {
+				return nil, err
+			}
+		case !ra.ok || rb.less(ra):
+			c = append(c, Change32{Added, rb.key, rb.bits, 0, rb.v})
+			if err := rb.next(); err != nil {
+				return nil, err
+			}
+		default:
+			if ra.v != rb.v {
+				c = append(c, Change32{Changed, ra.key, ra.bits, ra.v, rb.v})
+			}
+			if err := ra.next(); err != nil {
+				return nil, err
+			}
+			if err := rb.next(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return c, nil
+}
+
+// Read the next entry, at the end of the stream e.ok is set to false.
+func (e *entryReader32) next() error {
+	for e.s.Scan() {
+		e.line++
+		l := strings.TrimSpace(e.s.Text())
+		if l == "" || l[0] == '#' {
+			continue
+		}
+		f := strings.Fields(l)
+		if len(f) != 2 {
+			return fmt.Errorf("bitradix: line %d: expected prefix and value", e.line)
+		}
+		_, ipnet, err := net.ParseCIDR(f[0])
+		if err != nil || ipnet.IP.To4() == nil {
+			return fmt.Errorf("bitradix: line %d: invalid prefix %q", e.line, f[0])
+		}
+		v, err := strconv.ParseUint(f[1], 10, 32)
+		if err != nil {
+			return fmt.Errorf("bitradix: line %d: invalid value %q", e.line, f[1])
+		}
+		ip := ipnet.IP.To4()
+		key := uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3])
+		bits, _ := ipnet.Mask.Size()
+		prev := *e
+		e.key, e.bits, e.v = key, bits, uint32(v)
+		if prev.ok && !prev.less(e) {
+			return fmt.Errorf("bitradix: line %d: entries not sorted", e.line)
+		}
+		e.ok = true
+		return nil
+	}
+	e.ok = false
+	return e.s.Err()
+}
+
+// Return true when the entry in e sorts before the one in f.
+func (e *entryReader32) less(f *entryReader32) bool {
+	return e.key < f.key || (e.key == f.key && e.bits < f.bits)
+}
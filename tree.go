@@ -0,0 +1,93 @@
+package bitradix
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Tree returns a drawing of the tree r for display in a terminal. Each node is
+// drawn on its own line with the branch taken to it, nodes with a key also
+// show the key in binary, aligned in a column, the number of significant bits and
+// the value:
+//
+//	.
+//	├─0  01000000000000000000000000000000/5 -> 2010
+//	└─1
+//	  ...
+func (r *Radix32) Tree() string {
+	type line struct{ draw, label string }
+	lines := make([]line, 0)
+	var tree func(x *Radix32, draw, indent string)
+	tree = func(x *Radix32, draw, indent string) {
+		l := line{draw: draw}
+		if x.set() {
+			l.label = fmt.Sprintf("%032b/%d -> %d", x.key, x.bits, x.Value)
+		}
+		lines = append(lines, l)
+		for i, b := range x.branch {
+			if b == nil {
+				continue
+			}
+			last := i == 1 || x.branch[1] == nil
+			if last {
+				tree(b, fmt.Sprintf("%s└─%d", indent, i), indent+"  ")
+			} else {
+				tree(b, fmt.Sprintf("%s├─%d", indent, i), indent+"│ ")
+			}
+		}
+	}
+	tree(r, ".", "")
+
+	width := 0
+	for _, l := range lines {
+		if w := utf8.RuneCountInString(l.draw); l.label != "" && w > width {
+			width = w
+		}
+	}
+	var s strings.Builder
+	for _, l := range lines {
+		s.WriteString(l.draw)
+		if l.label != "" {
+			s.WriteString(strings.Repeat(" ", width-utf8.RuneCountInString(l.draw)+2))
+			s.WriteString(l.label)
+		}
+		s.WriteByte('\n')
+	}
+	return s.String()
+}
+
+// SExpr returns the tree r as an s-expression. An internal node is written as
+// (node bit (0 ...) (1 ...)), where bit is the bit it branches on and a missing
+// branch is left out. When an internal node stores a key, (key key bits value)
+// follows the bit. A leaf node is written as (leaf key bits value) and an
+// empty tree as (). Keys are written as unsigned integers.
+func (r *Radix32) SExpr() string {
+	var s strings.Builder
+	r.sexpr(&s, bitSize32-1)
+	return s.String()
+}
+
+// Write the s-expression for r, which branches on bit, to s.
+func (r *Radix32) sexpr(s *strings.Builder, bit int) {
+	if r.Leaf() {
+		if !r.set() {
+			s.WriteString("()")
+			return
+		}
+		fmt.Fprintf(s, "(leaf %d %d %d)", r.key, r.bits, r.Value)
+		return
+	}
+	fmt.Fprintf(s, "(node %d", bit)
+	if r.set() {
+		fmt.Fprintf(s, " (key %d %d %d)", r.key, r.bits, r.Value)
+	}
+	for i, b := range r.branch {
+		if b != nil {
+			fmt.Fprintf(s, " (%d ", i)
+			b.sexpr(s, bit-1)
+			s.WriteByte(')')
+		}
+	}
+	s.WriteByte(')')
+}